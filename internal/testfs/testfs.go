@@ -0,0 +1,43 @@
+// Package testfs holds the afero filesystems the tests use to make writes fail
+package testfs
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// ErrDiskFull is what the writes of a FailingFs fail with
+var ErrDiskFull = errors.New("disk full")
+
+// FailingFs fails the writes to the files it creates with the suffix, any file when empty,
+// once Limit bytes went through
+type FailingFs struct {
+	afero.Fs
+	Suffix string
+	Limit  int
+}
+
+func (fs FailingFs) Create(name string) (afero.File, error) {
+	file, err := fs.Fs.Create(name)
+	if err != nil || !strings.HasSuffix(name, fs.Suffix) {
+		return file, err
+	}
+	return &failingFile{File: file, left: fs.Limit}, nil
+}
+
+type failingFile struct {
+	afero.File
+	left int
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if len(p) > f.left {
+		n, _ := f.File.Write(p[:f.left])
+		f.left = 0
+		return n, ErrDiskFull
+	}
+	f.left -= len(p)
+	return f.File.Write(p)
+}
@@ -0,0 +1,23 @@
+package jobs
+
+import "CSEFileManager/utils"
+
+// ValidateConfig reads and checks the log level, the lock durations and the job definitions of the job type from the current settings,
+// nothing is run. RESTORE and SEARCH take their input from the arguments, they have no definitions to check.
+func ValidateConfig(jobType string) error {
+	if _, err := utils.LogLevel(); err != nil {
+		return err
+	}
+	if _, _, err := utils.LockDurations(); err != nil {
+		return err
+	}
+	switch jobType {
+	case "", "ARCHIVE":
+		_, err := loadArchiveJobs()
+		return err
+	case "FUPM":
+		_, _, err := loadFupmJobs()
+		return err
+	}
+	return nil
+}
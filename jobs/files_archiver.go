@@ -3,15 +3,58 @@ package jobs
 import (
 	"CSEFileManager/models"
 	"CSEFileManager/utils"
+	"context"
+	"fmt"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"strconv"
+	"strings"
+	"time"
 )
 
-func RunArchiver() {
+// RunArchiver archives the files of every configured job, an error means the configuration is invalid and nothing ran.
+// Cancelling ctx stops the run between files.
+func RunArchiver(ctx context.Context) (*models.RunReport, error) {
 	log.Info().Msg("Starting archiver..")
+	jobList, err := loadArchiveJobs()
+	if err != nil {
+		return nil, err
+	}
+
+	report := models.NewRunReport("ARCHIVE")
+	report.OnFile = utils.ObserveFileResult
+	// jobs run concurrently, so every lock is held until the whole walk is done
+	lockedJobs := make([]models.ArchiveJob, 0, len(jobList))
+	for _, job := range jobList {
+		lock, ok := lockJob(ctx, report, job.JobId)
+		if !ok {
+			continue
+		}
+		defer lock.Release()
+		lockedJobs = append(lockedJobs, job)
+	}
+	utils.WalkDirectoryAndProcessFiles(ctx, lockedJobs, report)
+	report.Finish()
+	log.Info().Msg("Archiving completed")
+
+	templates := make(map[int]string)
+	for _, job := range jobList {
+		templates[job.JobId] = job.NotifyTemplate
+	}
+	utils.NotifyRunOutcome(report, templates)
+	return report, nil
+}
+
+// loadArchiveJobs reads and validates the ARCHIVE job definitions from the settings
+func loadArchiveJobs() ([]models.ArchiveJob, error) {
 	jobCount := viper.GetInt("ARCHIVE_JOB_COUNT")
 	log.Info().Msgf("archive job count: %d", jobCount)
+	if jobCount <= 0 {
+		return nil, fmt.Errorf("ARCHIVE_JOB_COUNT must be at least 1, got %d", jobCount)
+	}
+	if maxRoutines := viper.GetInt("ARCHIVE_JOB_MAX_ROUTINES"); maxRoutines <= 0 {
+		return nil, fmt.Errorf("ARCHIVE_JOB_MAX_ROUTINES must be at least 1, got %d", maxRoutines)
+	}
 
 	jobList := make([]models.ArchiveJob, jobCount)
 	for i := 0; i < jobCount; i++ {
@@ -22,7 +65,39 @@ func RunArchiver() {
 		log.Info().Msgf("ARCHIVE_FILE_PATTERNS%d=%s", idx, viper.GetString("ARCHIVE_FILE_PATTERNS"+strconv.Itoa(idx)))
 		log.Info().Msgf("ARCHIVE_PATTERN_SEPARATOR%d=%s", idx, viper.GetString("ARCHIVE_PATTERN_SEPARATOR"+strconv.Itoa(idx)))
 		log.Info().Msgf("ARCHIVE_OLDER_THAN%d=%s", idx, viper.GetString("ARCHIVE_OLDER_THAN"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_LARGER_THAN%d=%s", idx, viper.GetString("ARCHIVE_LARGER_THAN"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_KEEP_UNARCHIVED%d=%s", idx, viper.GetString("ARCHIVE_KEEP_UNARCHIVED"+strconv.Itoa(idx)))
 		log.Info().Msgf("ARCHIVE_DELETE_ORIGINAL_FILE%d=%s", idx, viper.GetString("ARCHIVE_DELETE_ORIGINAL_FILE"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_INCLUDE_OPEN_FILES%d=%s", idx, viper.GetString("ARCHIVE_INCLUDE_OPEN_FILES"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_FOLDER_LAYOUT%d=%s", idx, viper.GetString("ARCHIVE_FOLDER_LAYOUT"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_DATE_SOURCE%d=%s", idx, viper.GetString("ARCHIVE_DATE_SOURCE"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_NAME_DATE_FORMAT%d=%s", idx, viper.GetString("ARCHIVE_NAME_DATE_FORMAT"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_NAME_DATE_REGEX%d=%s", idx, viper.GetString("ARCHIVE_NAME_DATE_REGEX"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_ON_COLLISION%d=%s", idx, viper.GetString("ARCHIVE_ON_COLLISION"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_ENCRYPT_RECIPIENTS%d=%s", idx, viper.GetString("ARCHIVE_ENCRYPT_RECIPIENTS"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_JOB_TIMEOUT%d=%s", idx, viper.GetString("ARCHIVE_JOB_TIMEOUT"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_FILE_TIMEOUT%d=%s", idx, viper.GetString("ARCHIVE_FILE_TIMEOUT"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_NOTIFY_TEMPLATE%d=%s", idx, viper.GetString("ARCHIVE_NOTIFY_TEMPLATE"+strconv.Itoa(idx)))
+		log.Info().Msgf("ARCHIVE_LOG_LEVEL%d=%s", idx, viper.GetString("ARCHIVE_LOG_LEVEL"+strconv.Itoa(idx)))
+
+		olderThan, err := parseArchiveAge(viper.GetString("ARCHIVE_OLDER_THAN" + strconv.Itoa(idx)))
+		if err != nil {
+			return nil, fmt.Errorf("ARCHIVE_OLDER_THAN%d: %w", idx, err)
+		}
+		var largerThan int64
+		if value := viper.GetString("ARCHIVE_LARGER_THAN" + strconv.Itoa(idx)); value != "" {
+			if largerThan, err = utils.ParseSize(value); err != nil {
+				return nil, fmt.Errorf("ARCHIVE_LARGER_THAN%d: %w", idx, err)
+			}
+		}
+
+		originalFile, err := parseOriginalFile(viper.GetString("ARCHIVE_DELETE_ORIGINAL_FILE" + strconv.Itoa(idx)))
+		if err != nil {
+			return nil, fmt.Errorf("ARCHIVE_DELETE_ORIGINAL_FILE%d: %w", idx, err)
+		}
+
+		nameDateFormat := viper.GetString("ARCHIVE_NAME_DATE_FORMAT" + strconv.Itoa(idx))
+		nameDateRegex := viper.GetString("ARCHIVE_NAME_DATE_REGEX" + strconv.Itoa(idx))
 
 		jobList[i] = models.ArchiveJob{
 			JobId:                idx,
@@ -30,16 +105,143 @@ func RunArchiver() {
 			ArchiveToPath:        viper.GetString("ARCHIVE_TO_PATH" + strconv.Itoa(idx)),
 			FilePattern:          viper.GetString("ARCHIVE_FILE_PATTERNS" + strconv.Itoa(idx)),
 			FilePatternSeparator: viper.GetString("ARCHIVE_PATTERN_SEPARATOR" + strconv.Itoa(idx)),
-			ArchiveIfOlderThan: func() int {
-				val := viper.GetInt("ARCHIVE_OLDER_THAN" + strconv.Itoa(idx))
-				if val == 0 {
-					val = 24
+			ArchiveIfOlderThan:   olderThan,
+			ArchiveIfLargerThan:  largerThan,
+			KeepUnarchived:       viper.GetInt("ARCHIVE_KEEP_UNARCHIVED" + strconv.Itoa(idx)),
+			OriginalFile:         originalFile,
+			IncludeOpenFiles:     viper.GetBool("ARCHIVE_INCLUDE_OPEN_FILES" + strconv.Itoa(idx)),
+			FolderLayout: func() string {
+				layout := viper.GetString("ARCHIVE_FOLDER_LAYOUT" + strconv.Itoa(idx))
+				if layout == "" {
+					layout = utils.DefaultFolderLayout
+				}
+				return layout
+			}(),
+			DateSource: func() string {
+				source := strings.ToLower(viper.GetString("ARCHIVE_DATE_SOURCE" + strconv.Itoa(idx)))
+				if source == "" && (nameDateFormat != "" || nameDateRegex != "") {
+					source = models.DateSourceFileName
+				} else if source == "" {
+					source = models.DateSourceModTime
+				}
+				return source
+			}(),
+			NameDateFormat: nameDateFormat,
+			NameDateRegex:  nameDateRegex,
+			OnCollision: func() string {
+				policy := strings.ToLower(viper.GetString("ARCHIVE_ON_COLLISION" + strconv.Itoa(idx)))
+				if policy == "" {
+					policy = models.OnCollisionVersion
 				}
-				return val
+				return policy
 			}(),
-			DeleteOriginalFile: viper.GetBool("ARCHIVE_DELETE_ORIGINAL_FILE" + strconv.Itoa(idx)),
+			EncryptRecipients: viper.GetString("ARCHIVE_ENCRYPT_RECIPIENTS" + strconv.Itoa(idx)),
+			NotifyTemplate:    viper.GetString("ARCHIVE_NOTIFY_TEMPLATE" + strconv.Itoa(idx)),
+			LogLevel:          viper.GetString("ARCHIVE_LOG_LEVEL" + strconv.Itoa(idx)),
+			JobTimeout:        viper.GetDuration("ARCHIVE_JOB_TIMEOUT" + strconv.Itoa(idx)),
+			FileTimeout:       viper.GetDuration("ARCHIVE_FILE_TIMEOUT" + strconv.Itoa(idx)),
 		}
 	}
-	utils.WalkDirectoryAndProcessFiles(jobList)
-	log.Info().Msg("Archiving completed")
+	for _, job := range jobList {
+		if err := validateArchiveJob(job); err != nil {
+			return nil, err
+		}
+	}
+	return jobList, nil
+}
+
+// parseArchiveAge reads ARCHIVE_OLDER_THAN: a duration (30m, 7d), a bare number of hours,
+// or none to archive regardless of age. Empty and 0 keep the 24 hours default.
+func parseArchiveAge(value string) (time.Duration, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case "", "0":
+		return 24 * time.Hour, nil
+	case "none":
+		return 0, nil
+	}
+	if hours, err := strconv.Atoi(value); err == nil {
+		if hours < 0 {
+			return 0, fmt.Errorf("age cannot be negative, got %d", hours)
+		}
+		return time.Duration(hours) * time.Hour, nil
+	}
+	age, err := utils.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("age must be positive, use none to archive regardless of age")
+	}
+	return age, nil
+}
+
+// parseOriginalFile reads ARCHIVE_DELETE_ORIGINAL_FILE: true deletes, false (or empty) keeps, truncate empties the file in place
+func parseOriginalFile(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "false", models.OriginalFileKeep:
+		return models.OriginalFileKeep, nil
+	case "true", models.OriginalFileDelete:
+		return models.OriginalFileDelete, nil
+	case models.OriginalFileTruncate, "copytruncate":
+		return models.OriginalFileTruncate, nil
+	}
+	return "", fmt.Errorf("expected true, false or truncate, got %q", value)
+}
+
+func validateArchiveJob(job models.ArchiveJob) error {
+	if job.ArchiveFromPath == "" {
+		return fmt.Errorf("ARCHIVE_FROM_PATH%d is not set", job.JobId)
+	}
+	if job.ArchiveToPath == "" {
+		return fmt.Errorf("ARCHIVE_TO_PATH%d is not set", job.JobId)
+	}
+	if job.FilePattern == "" {
+		return fmt.Errorf("ARCHIVE_FILE_PATTERNS%d is not set", job.JobId)
+	}
+	if job.FilePatternSeparator == "" {
+		return fmt.Errorf("ARCHIVE_PATTERN_SEPARATOR%d is not set", job.JobId)
+	}
+	if job.EncryptRecipients != "" {
+		if _, err := utils.LoadRecipients(job.EncryptRecipients); err != nil {
+			return fmt.Errorf("ARCHIVE_ENCRYPT_RECIPIENTS%d: %w", job.JobId, err)
+		}
+	}
+	if job.OriginalFile == models.OriginalFileTruncate && utils.IsS3URI(job.ArchiveFromPath) {
+		return fmt.Errorf("ARCHIVE_DELETE_ORIGINAL_FILE%d: objects in %s cannot be truncated", job.JobId, job.ArchiveFromPath)
+	}
+	if err := utils.ValidateFolderLayout(job.FolderLayout); err != nil {
+		return fmt.Errorf("ARCHIVE_FOLDER_LAYOUT%d: %w", job.JobId, err)
+	}
+	switch job.DateSource {
+	case models.DateSourceModTime, models.DateSourceFileName, models.DateSourceRun:
+	default:
+		return fmt.Errorf("ARCHIVE_DATE_SOURCE%d must be mtime, name or run, got %s", job.JobId, job.DateSource)
+	}
+	if job.NameDateFormat != "" || job.NameDateRegex != "" {
+		if job.DateSource != models.DateSourceFileName {
+			return fmt.Errorf("ARCHIVE_NAME_DATE_FORMAT%d and ARCHIVE_NAME_DATE_REGEX%d need ARCHIVE_DATE_SOURCE%d=name", job.JobId, job.JobId, job.JobId)
+		}
+		if _, err := utils.NewFileNameDateRule(job.NameDateFormat, job.NameDateRegex); err != nil {
+			return fmt.Errorf("ARCHIVE_NAME_DATE_FORMAT%d: %w", job.JobId, err)
+		}
+	}
+	switch job.OnCollision {
+	case models.OnCollisionVersion, models.OnCollisionTimestamp, models.OnCollisionPrefix, models.OnCollisionFail, models.OnCollisionOverwrite:
+	default:
+		return fmt.Errorf("ARCHIVE_ON_COLLISION%d must be version, timestamp, prefix, fail or overwrite, got %s", job.JobId, job.OnCollision)
+	}
+	if job.KeepUnarchived < 0 {
+		return fmt.Errorf("ARCHIVE_KEEP_UNARCHIVED%d cannot be negative", job.JobId)
+	}
+	if job.JobTimeout < 0 || job.FileTimeout < 0 {
+		return fmt.Errorf("ARCHIVE_JOB_TIMEOUT%d and ARCHIVE_FILE_TIMEOUT%d cannot be negative", job.JobId, job.JobId)
+	}
+	if err := utils.ValidateNotifyTemplate(job.NotifyTemplate); err != nil {
+		return fmt.Errorf("ARCHIVE_NOTIFY_TEMPLATE%d: %w", job.JobId, err)
+	}
+	if _, err := utils.ParseLogLevel(job.LogLevel); err != nil {
+		return fmt.Errorf("ARCHIVE_LOG_LEVEL%d: %w", job.JobId, err)
+	}
+	return nil
 }
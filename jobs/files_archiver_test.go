@@ -0,0 +1,32 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseArchiveAge(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 24 * time.Hour},
+		{" ", 24 * time.Hour},
+		{"0", 24 * time.Hour},
+		{"none", 0},
+		{"NONE", 0},
+		{"48", 48 * time.Hour},
+		{"7d", 7 * 24 * time.Hour},
+		{"30m", 30 * time.Minute},
+		{"1w", 7 * 24 * time.Hour},
+	} {
+		if got, err := parseArchiveAge(test.value); err != nil || got != test.want {
+			t.Errorf("parseArchiveAge(%q) = %s, %v, want %s", test.value, got, err, test.want)
+		}
+	}
+	for _, value := range []string{"-1", "0s", "-2h", "week", "7 days"} {
+		if got, err := parseArchiveAge(value); err == nil {
+			t.Errorf("parseArchiveAge(%q) = %s, want an error", value, got)
+		}
+	}
+}
@@ -2,44 +2,92 @@ package jobs
 
 import (
 	"CSEFileManager/models"
+	"CSEFileManager/utils"
+	"context"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/csv"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"filippo.io/age"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	go_ora "github.com/sijms/go-ora/v2"
+	"github.com/spf13/afero"
 	"github.com/spf13/viper"
 )
 
 var AppFlags models.Args
 
+// CSVRegistry is safe for concurrent use, file routines of all jobs share it
 type CSVRegistry struct {
-	filePath    string
-	records     map[string]bool            // key: filename_jobname for quick lookup
-	dateRecords map[string]map[string]bool // key: date -> filename -> true
+	filePath     string
+	records      map[string]bool            // key: filename_jobname for quick lookup
+	dateRecords  map[string]map[string]bool // key: date -> filename -> true
+	inFlight     map[string]bool            // files reserved by a routine, keyed like records
+	dateInFlight map[string]map[string]int  // routines holding a file, keyed like dateRecords
+	mu           sync.Mutex
 }
 
 func NewCSVRegistry(filePath string) *CSVRegistry {
 	registry := &CSVRegistry{
-		filePath:    filePath,
-		records:     make(map[string]bool),
-		dateRecords: make(map[string]map[string]bool),
+		filePath:     filePath,
+		records:      make(map[string]bool),
+		dateRecords:  make(map[string]map[string]bool),
+		inFlight:     make(map[string]bool),
+		dateInFlight: make(map[string]map[string]int),
 	}
 	registry.load()
 	return registry
 }
 
-func RunFupmJobs(appFlags models.Args) {
+// RunFupmJobs transfers the files of every configured job, an error means the configuration is invalid and nothing ran.
+// Cancelling ctx stops the run between files.
+func RunFupmJobs(ctx context.Context, appFlags models.Args) (*models.RunReport, error) {
 	AppFlags = appFlags
 	log.Info().Msg("Starting fupm uploader..")
+	jobList, maxRoutines, err := loadFupmJobs()
+	if err != nil {
+		return nil, err
+	}
+
+	report := models.NewRunReport("FUPM")
+	report.OnFile = utils.ObserveFileResult
+	WalkDirAndPlayFile(ctx, jobList, maxRoutines, report)
+	report.Finish()
+
+	templates := make(map[int]string)
+	for _, job := range jobList {
+		templates[job.JobId] = job.NotifyTemplate
+	}
+	utils.NotifyRunOutcome(report, templates)
+	return report, nil
+}
+
+// loadFupmJobs reads and validates the FUPM job definitions and the routine limit from the settings
+func loadFupmJobs() ([]models.FupmJob, int, error) {
 	jobCount := viper.GetInt("FUPM_JOB_COUNT")
 	log.Info().Msgf("fupm job count: %d", jobCount)
+	if jobCount <= 0 {
+		return nil, 0, fmt.Errorf("FUPM_JOB_COUNT must be at least 1, got %d", jobCount)
+	}
+
+	maxRoutines := viper.GetInt("FUPM_JOB_MAX_ROUTINES")
+	log.Info().Msgf("fupm max routines: %d", maxRoutines)
+	if viper.GetString("FUPM_JOB_MAX_ROUTINES") == "" {
+		maxRoutines = 1 // serial, as before the setting existed
+	} else if maxRoutines <= 0 {
+		return nil, 0, fmt.Errorf("FUPM_JOB_MAX_ROUTINES must be at least 1, got %d", maxRoutines)
+	}
 
 	jobList := make([]models.FupmJob, jobCount)
 
@@ -52,6 +100,27 @@ func RunFupmJobs(appFlags models.Args) {
 		log.Info().Msgf("FUPM_FILE_TO_PATH%d=%s", idx, viper.GetString("FUPM_FILE_TO_PATH"+strconv.Itoa(idx)))
 		log.Info().Msgf("FUPM_FILE_UPLOAD_SQL_SCRIPT%d=%s", idx, viper.GetString("FUPM_FILE_UPLOAD_SQL_SCRIPT"+strconv.Itoa(idx)))
 		log.Info().Msgf("FUPM_PROCESS_ONCE%d=%s", idx, viper.GetString("FUPM_PROCESS_ONCE"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_VERIFY_CHECKSUM%d=%s", idx, viper.GetString("FUPM_VERIFY_CHECKSUM"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_WRITE_CHECKSUM_FILE%d=%s", idx, viper.GetString("FUPM_WRITE_CHECKSUM_FILE"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_ENCRYPT_RECIPIENTS%d=%s", idx, viper.GetString("FUPM_ENCRYPT_RECIPIENTS"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_KEEP_ORDER%d=%s", idx, viper.GetString("FUPM_KEEP_ORDER"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_JOB_TIMEOUT%d=%s", idx, viper.GetString("FUPM_JOB_TIMEOUT"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_FILE_TIMEOUT%d=%s", idx, viper.GetString("FUPM_FILE_TIMEOUT"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_NOTIFY_TEMPLATE%d=%s", idx, viper.GetString("FUPM_NOTIFY_TEMPLATE"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_LOG_LEVEL%d=%s", idx, viper.GetString("FUPM_LOG_LEVEL"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_SFTP_HOST%d=%s", idx, viper.GetString("FUPM_SFTP_HOST"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_SFTP_PORT%d=%s", idx, viper.GetString("FUPM_SFTP_PORT"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_SFTP_USER%d=%s", idx, viper.GetString("FUPM_SFTP_USER"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_SFTP_KEY_PATH%d=%s", idx, viper.GetString("FUPM_SFTP_KEY_PATH"+strconv.Itoa(idx)))
+		log.Info().Msgf("FUPM_SFTP_KNOWN_HOSTS%d=%s", idx, viper.GetString("FUPM_SFTP_KNOWN_HOSTS"+strconv.Itoa(idx)))
+		sftpPassword, err := utils.Secret("FUPM_SFTP_PASS" + strconv.Itoa(idx))
+		if err != nil {
+			return nil, 0, err
+		}
+		sftpKeyPassphrase, err := utils.Secret("FUPM_SFTP_KEY_PASSPHRASE" + strconv.Itoa(idx))
+		if err != nil {
+			return nil, 0, err
+		}
 
 		jobList[i] = models.FupmJob{
 			JobId:                idx,
@@ -61,12 +130,78 @@ func RunFupmJobs(appFlags models.Args) {
 			FileTransferToPath:   viper.GetString("FUPM_FILE_TO_PATH" + strconv.Itoa(idx)),
 			FileUploadSqlScript:  viper.GetString("FUPM_FILE_UPLOAD_SQL_SCRIPT" + strconv.Itoa(idx)),
 			ProcessOnce:          viper.GetBool("FUPM_PROCESS_ONCE" + strconv.Itoa(idx)),
+			KeepOrder:            viper.GetBool("FUPM_KEEP_ORDER" + strconv.Itoa(idx)),
+			VerifyChecksum: func() bool {
+				// verify unless explicitly switched off
+				key := "FUPM_VERIFY_CHECKSUM" + strconv.Itoa(idx)
+				if !viper.IsSet(key) || viper.GetString(key) == "" {
+					return true
+				}
+				return viper.GetBool(key)
+			}(),
+			WriteChecksumFile: viper.GetBool("FUPM_WRITE_CHECKSUM_FILE" + strconv.Itoa(idx)),
+			EncryptRecipients: viper.GetString("FUPM_ENCRYPT_RECIPIENTS" + strconv.Itoa(idx)),
+			NotifyTemplate:    viper.GetString("FUPM_NOTIFY_TEMPLATE" + strconv.Itoa(idx)),
+			LogLevel:          viper.GetString("FUPM_LOG_LEVEL" + strconv.Itoa(idx)),
+			JobTimeout:        viper.GetDuration("FUPM_JOB_TIMEOUT" + strconv.Itoa(idx)),
+			FileTimeout:       viper.GetDuration("FUPM_FILE_TIMEOUT" + strconv.Itoa(idx)),
+			Sftp: models.SftpConfig{
+				Host:           viper.GetString("FUPM_SFTP_HOST" + strconv.Itoa(idx)),
+				Port:           viper.GetInt("FUPM_SFTP_PORT" + strconv.Itoa(idx)),
+				User:           viper.GetString("FUPM_SFTP_USER" + strconv.Itoa(idx)),
+				Password:       sftpPassword,
+				KeyPath:        viper.GetString("FUPM_SFTP_KEY_PATH" + strconv.Itoa(idx)),
+				KeyPassphrase:  sftpKeyPassphrase,
+				KnownHostsPath: viper.GetString("FUPM_SFTP_KNOWN_HOSTS" + strconv.Itoa(idx)),
+			},
+		}
+	}
+	for _, job := range jobList {
+		if err := validateFupmJob(job); err != nil {
+			return nil, 0, err
+		}
+	}
+	return jobList, maxRoutines, nil
+}
+
+func validateFupmJob(job models.FupmJob) error {
+	if job.FilePattern == "" {
+		return fmt.Errorf("FUPM_FILE_PATTERN%d is not set", job.JobId)
+	}
+	if job.FileTransferFromPath == "" {
+		return fmt.Errorf("FUPM_FILE_FROM_PATH%d is not set", job.JobId)
+	}
+	if job.FileTransferToPath == "" {
+		return fmt.Errorf("FUPM_FILE_TO_PATH%d is not set", job.JobId)
+	}
+	switch strings.ToUpper(job.FileTransferType) {
+	case "COPY", "MOVE":
+	case TransferTypeSftpGet, TransferTypeSftpPut:
+		if job.Sftp.Host == "" {
+			return fmt.Errorf("FUPM_SFTP_HOST%d is required for %s", job.JobId, job.FileTransferType)
+		}
+	default:
+		return fmt.Errorf("FUPM_FILE_TRANSFER_TYPE%d has unknown transfer type %q", job.JobId, job.FileTransferType)
+	}
+	if job.EncryptRecipients != "" {
+		if _, err := utils.LoadRecipients(job.EncryptRecipients); err != nil {
+			return fmt.Errorf("FUPM_ENCRYPT_RECIPIENTS%d: %w", job.JobId, err)
 		}
 	}
-	WalkDirAndPlayFile(jobList)
+	if job.JobTimeout < 0 || job.FileTimeout < 0 {
+		return fmt.Errorf("FUPM_JOB_TIMEOUT%d and FUPM_FILE_TIMEOUT%d cannot be negative", job.JobId, job.JobId)
+	}
+	if err := utils.ValidateNotifyTemplate(job.NotifyTemplate); err != nil {
+		return fmt.Errorf("FUPM_NOTIFY_TEMPLATE%d: %w", job.JobId, err)
+	}
+	if _, err := utils.ParseLogLevel(job.LogLevel); err != nil {
+		return fmt.Errorf("FUPM_LOG_LEVEL%d: %w", job.JobId, err)
+	}
+	return nil
 }
 
-func WalkDirAndPlayFile(jobList []models.FupmJob) {
+// WalkDirAndPlayFile runs up to maxRoutines jobs at once, their files sharing maxRoutines transfer slots
+func WalkDirAndPlayFile(ctx context.Context, jobList []models.FupmJob, maxRoutines int, report *models.RunReport) {
 	log.Info().Msg("Starting file processing...")
 
 	csvFilePath := viper.GetString("CSV_REGISTRY_PATH")
@@ -75,44 +210,109 @@ func WalkDirAndPlayFile(jobList []models.FupmJob) {
 	}
 	registry := NewCSVRegistry(csvFilePath)
 	log.Info().Msgf("Using CSV registry: %s", csvFilePath)
+	defer closeFupmDB()
+
+	// separate pools, a job waiting on file slots never holds one
+	jobSlots := make(chan struct{}, maxRoutines)
+	fileSlots := make(chan struct{}, maxRoutines)
+	var wg sync.WaitGroup
 
 	for _, job := range jobList {
-		log.Info().Msgf("Processing job %d", job.JobId)
-		processJobFiles(job, registry)
+		logger := utils.JobLogger(report, job.JobId, job.LogLevel)
+		if err := ctx.Err(); err != nil {
+			logger.Warn().Msgf("Not starting job %d: %v", job.JobId, err)
+			report.JobFailed(job.JobId, fmt.Errorf("job not started: %w", err))
+			continue
+		}
+		select {
+		case jobSlots <- struct{}{}:
+		case <-ctx.Done():
+			logger.Warn().Msgf("Not starting job %d: %v", job.JobId, ctx.Err())
+			report.JobFailed(job.JobId, fmt.Errorf("job not started: %w", ctx.Err()))
+			continue
+		}
+
+		wg.Add(1)
+		go func(job models.FupmJob) {
+			defer wg.Done()
+			defer func() { <-jobSlots }()
+
+			lock, ok := lockJob(ctx, report, job.JobId)
+			if !ok {
+				return
+			}
+			defer lock.Release()
+			// another process may have registered files while we waited for the lock
+			registry.load()
+			logger.Info().Msgf("Processing job %d", job.JobId)
+			processJobFiles(ctx, job, registry, fileSlots, report)
+		}(job)
 	}
+	wg.Wait()
 }
 
-func processJobFiles(job models.FupmJob, registry *CSVRegistry) {
-	log.Info().Msgf("Processing files for job %d from %s", job.JobId, job.FileTransferFromPath)
-	jobName := fmt.Sprintf("Job_%d_%s", job.JobId, job.FileTransferType)
+// processJobFiles sets up the job then transfers its files, each taking one of the file slots
+func processJobFiles(ctx context.Context, job models.FupmJob, registry *CSVRegistry, fileSlots chan struct{}, report *models.RunReport) {
+	logger := utils.JobLogger(report, job.JobId, job.LogLevel)
+	logger.Info().Msgf("Processing files for job %d from %s", job.JobId, job.FileTransferFromPath)
+	ctx, cancel := utils.WithTimeout(ctx, job.JobTimeout)
+	defer cancel()
+
+	transfer, pattern, ok := openFupmTransfer(job, report)
+	if !ok {
+		return
+	}
+	defer transfer.Close()
+
+	// Create full path pattern for glob
+	fullPattern := filepath.Join(job.FileTransferFromPath, pattern)
+
+	// Find all files matching the pattern
+	matchingFiles, err := utils.GlobContext(ctx, transfer.sourceFs, fullPattern)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Error finding files with pattern %s", fullPattern)
+		report.JobFailed(job.JobId, err)
+		return
+	}
+
+	report.AddMatched(job.JobId, len(matchingFiles))
+	if len(matchingFiles) == 0 {
+		logger.Warn().Msgf("No files found matching pattern: %s", pattern)
+		return
+	}
+
+	logger.Info().Msgf("Found %d files matching pattern", len(matchingFiles))
+	transferFiles(ctx, transfer, matchingFiles, registry, fileSlots, report)
+}
 
+// resolveFupmPattern replaces the YYYYMMDD or YYMMDD token of the job pattern with the date in arg1, or the date of now.
+// The registry date is always YYYYMMDD.
+func resolveFupmPattern(job models.FupmJob, dateArg string, now time.Time, logger zerolog.Logger) (string, string, error) {
 	var date string
 	var actualPattern string
 
-	if AppFlags.Arg1 == "" {
-		// Get today's date
-		now := time.Now()
-		log.Info().Msgf("No arg1 passed, using today's date")
+	if dateArg == "" {
+		logger.Debug().Msgf("No arg1 passed, using today's date")
 
 		// Check which date format is used in the pattern
 		if strings.Contains(job.FilePattern, "YYYYMMDD") {
 			date = now.Format("20060102") // YYYYMMDD format
 			actualPattern = strings.ReplaceAll(job.FilePattern, "YYYYMMDD", date)
-			log.Info().Msgf("Using YYYYMMDD format, date: %s", date)
+			logger.Debug().Msgf("Using YYYYMMDD format, date: %s", date)
 		} else if strings.Contains(job.FilePattern, "YYMMDD") {
 			date = now.Format("060102") // YYMMDD format
 			actualPattern = strings.ReplaceAll(job.FilePattern, "YYMMDD", date)
-			log.Info().Msgf("Using YYMMDD format, date: %s", date)
+			logger.Debug().Msgf("Using YYMMDD format, date: %s", date)
 		} else {
 			// No date pattern found, use pattern as-is
 			actualPattern = job.FilePattern
 			date = now.Format("20060102") // Default for registry tracking
-			log.Info().Msg("No date pattern found in file pattern, using as-is")
+			logger.Debug().Msg("No date pattern found in file pattern, using as-is")
 		}
 	} else {
 		// Use provided date from Arg1
-		providedDate := AppFlags.Arg1
-		log.Info().Msgf("Using date from arg1: %s", providedDate)
+		providedDate := dateArg
+		logger.Debug().Msgf("Using date from arg1: %s", providedDate)
 
 		// Determine format and convert if needed
 		if strings.Contains(job.FilePattern, "YYYYMMDD") {
@@ -124,130 +324,306 @@ func processJobFiles(job models.FupmJob, registry *CSVRegistry) {
 				} else {
 					date = "20" + providedDate
 				}
-				log.Info().Msgf("Converted YYMMDD %s to YYYYMMDD %s", providedDate, date)
+				logger.Debug().Msgf("Converted YYMMDD %s to YYYYMMDD %s", providedDate, date)
 			} else if len(providedDate) == 8 {
 				date = providedDate
 			} else {
-				log.Error().Msgf("Invalid date format in arg1: %s (expected YYMMDD or YYYYMMDD)", providedDate)
-				return
+				return "", "", fmt.Errorf("invalid date format in arg1: %s (expected YYMMDD or YYYYMMDD)", providedDate)
 			}
 			actualPattern = strings.ReplaceAll(job.FilePattern, "YYYYMMDD", date)
 		} else if strings.Contains(job.FilePattern, "YYMMDD") {
 			if len(providedDate) == 8 {
 				// Convert YYYYMMDD to YYMMDD
 				date = providedDate[2:] // Take last 6 characters
-				log.Info().Msgf("Converted YYYYMMDD %s to YYMMDD %s", providedDate, date)
+				logger.Debug().Msgf("Converted YYYYMMDD %s to YYMMDD %s", providedDate, date)
 			} else if len(providedDate) == 6 {
 				date = providedDate
 			} else {
-				log.Error().Msgf("Invalid date format in arg1: %s (expected YYMMDD or YYYYMMDD)", providedDate)
-				return
+				return "", "", fmt.Errorf("invalid date format in arg1: %s (expected YYMMDD or YYYYMMDD)", providedDate)
 			}
 			actualPattern = strings.ReplaceAll(job.FilePattern, "YYMMDD", date)
 		} else {
 			// No date pattern found
 			actualPattern = job.FilePattern
 			date = providedDate
-			log.Info().Msg("No date pattern found in file pattern, using provided date for registry tracking")
+			logger.Debug().Msg("No date pattern found in file pattern, using provided date for registry tracking")
 		}
 	}
 
-	log.Info().Msgf("Final pattern after date replacement: %s", actualPattern)
-
-	// Create full path pattern for glob
-	fullPattern := filepath.Join(job.FileTransferFromPath, actualPattern)
+	// For registry checking, always use YYYYMMDD format for consistency
+	registryDate := date
+	if len(date) == 6 {
+		// Convert YYMMDD to YYYYMMDD for registry
+		year := date[:2]
+		if year > "50" {
+			registryDate = "19" + date
+		} else {
+			registryDate = "20" + date
+		}
+	}
+	return actualPattern, registryDate, nil
+}
 
-	// Find all files matching the pattern
-	matchingFiles, err := filepath.Glob(fullPattern)
+// openFupmTransfer resolves the pattern of the job and opens its storages, along with the sftp session it needs.
+// The transfer must be closed once its files are done, ok is false when the job failed and is already reported.
+func openFupmTransfer(job models.FupmJob, report *models.RunReport) (transfer *fupmTransfer, pattern string, ok bool) {
+	logger := utils.JobLogger(report, job.JobId, job.LogLevel)
+	pattern, registryDate, err := resolveFupmPattern(job, AppFlags.Arg1, time.Now(), logger)
 	if err != nil {
-		log.Error().Err(err).Msgf("Error finding files with pattern %s", fullPattern)
-		return
+		logger.Error().Err(err).Msgf("Unable to resolve the file pattern of job %d", job.JobId)
+		report.JobFailed(job.JobId, err)
+		return nil, "", false
 	}
-
-	if len(matchingFiles) == 0 {
-		log.Warn().Msgf("No files found matching pattern: %s", actualPattern)
-		return
+	logger.Info().Msgf("Final pattern after date replacement: %s", pattern)
+
+	transfer = &fupmTransfer{
+		job:          job,
+		jobName:      fmt.Sprintf("Job_%d_%s", job.JobId, job.FileTransferType),
+		registryDate: registryDate,
+		transferType: strings.ToUpper(job.FileTransferType),
+		sourceFs:     utils.LocalFs,
+		logger:       logger,
 	}
 
-	log.Info().Msgf("Found %d files matching pattern", len(matchingFiles))
-
-	// Process each matching file
-	for _, sourceFile := range matchingFiles {
-		fileName := filepath.Base(sourceFile)
-		log.Info().Msgf("Processing file: %s", fileName)
+	// Resolve where files come from and go to, local disk or object storage
+	transfer.targetFs, transfer.targetRoot, err = utils.ResolveStorage(job.FileTransferToPath)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Unable to open destination %s for job %d", job.FileTransferToPath, job.JobId)
+		report.JobFailed(job.JobId, err)
+		return nil, "", false
+	}
 
-		// For registry checking, always use YYYYMMDD format for consistency
-		registryDate := date
-		if len(date) == 6 {
-			// Convert YYMMDD to YYYYMMDD for registry
-			year := date[:2]
-			if year > "50" {
-				registryDate = "19" + date
-			} else {
-				registryDate = "20" + date
-			}
+	if job.EncryptRecipients != "" {
+		transfer.recipients, err = utils.LoadRecipients(job.EncryptRecipients)
+		if err != nil {
+			logger.Error().Err(err).Msgf("Unable to load encryption recipients for job %d", job.JobId)
+			report.JobFailed(job.JobId, err)
+			return nil, "", false
 		}
+		logger.Info().Msgf("Files of job %d will be encrypted for %d recipients", job.JobId, len(transfer.recipients))
+	}
 
-		// Check based on ProcessOnce setting
-		if job.ProcessOnce {
-			// Check if file already processed on this date
-			log.Debug().Msgf("ProcessOnce=true, checking if file %s was processed on date %s", fileName, registryDate)
-			if registry.IsProcessedOnDate(fileName, registryDate) {
-				log.Info().Msgf("File %s already processed on date %s (ProcessOnce=true), skipping", fileName, registryDate)
-				continue
-			}
-			log.Debug().Msgf("File %s not found in date registry for %s, proceeding with processing", fileName, registryDate)
+	// Open the sftp session once for the whole job, the remote side replaces one end
+	if isSftpTransfer(transfer.transferType) {
+		transfer.session, err = newSftpSession(job.Sftp, logger)
+		if err != nil {
+			logger.Error().Err(err).Msgf("Unable to open sftp session for job %d", job.JobId)
+			report.JobFailed(job.JobId, err)
+			return nil, "", false
+		}
+		if transfer.transferType == TransferTypeSftpGet {
+			transfer.sourceFs = transfer.session.fs
 		} else {
-			// Check if file already processed for this specific job
-			log.Debug().Msgf("ProcessOnce=false, checking if file %s was processed by job %s", fileName, jobName)
-			if registry.IsProcessed(fileName, jobName) {
-				log.Info().Msgf("File %s already processed for %s, skipping", fileName, jobName)
-				continue
-			}
-			log.Debug().Msgf("File %s not found in job registry for %s, proceeding with processing", fileName, jobName)
+			transfer.targetFs, transfer.targetRoot = transfer.session.fs, job.FileTransferToPath
 		}
+	}
+	return transfer, pattern, true
+}
 
-		destinationFile := filepath.Join(job.FileTransferToPath, fileName)
+// transferFiles transfers the files of the job, each taking one of the file slots.
+// A job keeping order transfers one file at a time, in the order given.
+func transferFiles(ctx context.Context, transfer *fupmTransfer, files []string, registry *CSVRegistry, fileSlots chan struct{}, report *models.RunReport) {
+	job := transfer.job
+	var wg sync.WaitGroup
+	defer wg.Wait() // the sftp session is closed once every file is done
+	for i, sourceFile := range files {
+		if err := ctx.Err(); err != nil {
+			transfer.logger.Warn().Msgf("Stopping job %d with %d files left: %v", job.JobId, len(files)-i, err)
+			report.JobFailed(job.JobId, fmt.Errorf("stopped before %s: %w", sourceFile, err))
+			return
+		}
+		select {
+		case fileSlots <- struct{}{}:
+		case <-ctx.Done():
+			transfer.logger.Warn().Msgf("Stopping job %d with %d files left: %v", job.JobId, len(files)-i, ctx.Err())
+			report.JobFailed(job.JobId, fmt.Errorf("stopped before %s: %w", sourceFile, ctx.Err()))
+			return
+		}
 
-		// Perform the file operation based on transfer type
-		var operationErr error
-		switch strings.ToUpper(job.FileTransferType) {
-		case "COPY":
-			operationErr = copyFile(sourceFile, destinationFile)
-			if operationErr == nil {
-				log.Info().Msgf("Successfully copied: %s -> %s", sourceFile, destinationFile)
-			}
-		case "MOVE":
-			operationErr = moveFile(sourceFile, destinationFile)
-			if operationErr == nil {
-				log.Info().Msgf("Successfully moved: %s -> %s", sourceFile, destinationFile)
-			}
-		default:
-			log.Error().Msgf("Unknown transfer type: %s for job %d", job.FileTransferType, job.JobId)
+		if job.KeepOrder {
+			processJobFile(ctx, *transfer, sourceFile, registry, report)
+			<-fileSlots
 			continue
 		}
+		wg.Add(1)
+		go func(sourceFile string) {
+			defer wg.Done()
+			defer func() { <-fileSlots }()
+			processJobFile(ctx, *transfer, sourceFile, registry, report)
+		}(sourceFile)
+	}
+}
+
+// fupmTransfer is what every file of a job shares once the job is set up
+type fupmTransfer struct {
+	job          models.FupmJob
+	jobName      string
+	registryDate string
+	transferType string
+	sourceFs     afero.Fs
+	targetFs     afero.Fs
+	targetRoot   string
+	recipients   []age.Recipient
+	session      *sftpSession   // nil unless the job transfers over sftp
+	logger       zerolog.Logger // carries the job_id and run_id
+}
+
+// Close ends the sftp session of the transfer
+func (t *fupmTransfer) Close() {
+	if t.session != nil {
+		t.session.Close()
+	}
+}
+
+// processed tells whether the registry already holds the file for this job, or for this date when the job processes files once
+func (t fupmTransfer) processed(registry *CSVRegistry, fileName string) bool {
+	if t.job.ProcessOnce {
+		return registry.IsProcessedOnDate(fileName, t.registryDate, t.logger)
+	}
+	return registry.IsProcessed(fileName, t.jobName, t.logger)
+}
+
+// reserve holds the file for this job unless it is processed, checked like processed, or held by another routine
+func (t fupmTransfer) reserve(registry *CSVRegistry, fileName string, logger zerolog.Logger) (*RegistryReservation, bool) {
+	date := ""
+	if t.job.ProcessOnce {
+		date = t.registryDate
+	}
+	return registry.Reserve(fileName, t.jobName, date, logger)
+}
+
+// processJobFile transfers, inserts and registers one file, within the job's per file timeout whatever happens to ctx
+func processJobFile(ctx context.Context, t fupmTransfer, sourceFile string, registry *CSVRegistry, report *models.RunReport) {
+	job := t.job
+	start := time.Now()
+	fileName := filepath.Base(sourceFile)
+	logger := t.logger.With().Str("file", sourceFile).Logger()
+	logger.Info().Msgf("Processing file: %s", fileName)
+
+	// a started file is not abandoned on a stop or at the end of the job timeout, the file timeout alone bounds it
+	ctx, cancel := utils.WithTimeout(context.WithoutCancel(ctx), job.FileTimeout)
+	defer cancel()
+
+	fileInfo, err := t.sourceFs.Stat(sourceFile)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Unable to get file info for %s, skipping", sourceFile)
+		report.AddFailure(job.JobId, sourceFile, "stat", err, 0, 0, start)
+		return
+	}
+	if fileInfo.IsDir() {
+		logger.Info().Msgf("File %s is directory..skipping", fileName)
+		report.AddFile(job.JobId, sourceFile, models.FileStatusSkippedDirectory, nil, 0, 0, start)
+		return
+	}
 
-		// If operation was successful, add to CSV registry
+	// Checked and held under one lock, of the jobs matching the same file only one transfers it
+	reservation, ok := t.reserve(registry, fileName, logger)
+	if !ok {
+		logger.Info().Msgf("File %s already processed or being processed for %s (ProcessOnce=%t), skipping", fileName, t.jobName, job.ProcessOnce)
+		report.AddFile(job.JobId, sourceFile, models.FileStatusSkippedProcessed, nil, 0, 0, start)
+		return
+	}
+	defer reservation.Release()
+
+	destinationFile := filepath.Join(t.targetRoot, fileName)
+	if len(t.recipients) > 0 {
+		destinationFile += utils.EncryptedFileExtension
+	}
+	destinationLabel := utils.DescribeLocation(t.targetFs, destinationFile)
+
+	// Perform the file operation based on transfer type
+	var operationErr error
+	var bytesWritten int64
+	switch t.transferType {
+	case "COPY", TransferTypeSftpGet, TransferTypeSftpPut:
+		bytesWritten, operationErr = copyFile(ctx, t.sourceFs, sourceFile, t.targetFs, destinationFile, job.VerifyChecksum, t.recipients, logger)
 		if operationErr == nil {
-			if err := registry.AddFile(jobName, fileName, destinationFile); err != nil {
-				log.Error().Err(err).Msgf("Failed to add file %s to CSV registry", fileName)
-			} else {
-				log.Info().Msgf("Added file %s to CSV registry", fileName)
+			logger.Info().Msgf("Successfully copied: %s -> %s", sourceFile, destinationLabel)
+		}
+	case "MOVE":
+		bytesWritten, operationErr = moveFile(ctx, t.sourceFs, sourceFile, t.targetFs, destinationFile, t.recipients, logger)
+		if operationErr == nil {
+			logger.Info().Msgf("Successfully moved: %s -> %s", sourceFile, destinationLabel)
+		}
+	default:
+		logger.Error().Msgf("Unknown transfer type: %s for job %d", job.FileTransferType, job.JobId)
+		operationErr = fmt.Errorf("unknown transfer type %s", job.FileTransferType)
+	}
 
-				if job.FileUploadSqlScript != "" {
-					log.Info().Msg("SQL Script found... starting insert job...")
-					InsertFupm(job, fileName)
-				}
-			}
-		} else {
-			log.Error().Err(operationErr).Msgf("Failed to %s file %s", strings.ToLower(job.FileTransferType), fileName)
+	// Write the checksum sidecar for the downstream loader
+	if operationErr == nil && job.WriteChecksumFile {
+		if err := writeChecksumSidecar(t.targetFs, destinationFile, logger); err != nil {
+			logger.Error().Err(err).Msgf("Failed to write checksum file for %s", destinationLabel)
+		}
+	}
+
+	if operationErr != nil {
+		logger.Error().Err(operationErr).Msgf("Failed to %s file %s", strings.ToLower(job.FileTransferType), fileName)
+		report.AddFailure(job.JobId, sourceFile, "transfer", operationErr, fileInfo.Size(), bytesWritten, start)
+		return
+	}
+
+	// Inserted before registering, a file whose insert fails is not registered and is transferred again on the next run
+	if job.FileUploadSqlScript != "" {
+		logger.Info().Msg("SQL Script found... starting insert job...")
+		insertStart := time.Now()
+		err := InsertFupm(ctx, job, fileName, logger)
+		utils.ObserveDbInsert(time.Since(insertStart), err)
+		if err != nil {
+			report.AddFailure(job.JobId, sourceFile, "db_insert", fmt.Errorf("transferred but not inserted: %w", err), fileInfo.Size(), bytesWritten, start)
+			return
 		}
 	}
+
+	// Operation was successful, add to CSV registry
+	if err := reservation.Commit(destinationLabel, logger); err != nil {
+		logger.Error().Err(err).Msgf("Failed to add file %s to CSV registry", fileName)
+		report.AddFailure(job.JobId, sourceFile, "registry", fmt.Errorf("transferred but not registered: %w", err), fileInfo.Size(), bytesWritten, start)
+		return
+	}
+	logger.Info().Msgf("Added file %s to CSV registry", fileName)
+	report.AddFile(job.JobId, sourceFile, models.FileStatusTransferred, nil, fileInfo.Size(), bytesWritten, start)
+}
+
+// writeChecksumSidecar writes <destination>.sha256 next to the transferred file
+func writeChecksumSidecar(fs afero.Fs, destinationFile string, logger zerolog.Logger) error {
+	checksum, _, err := utils.FileChecksum(fs, destinationFile)
+	if err != nil {
+		return err
+	}
+	sidecar, err := utils.WriteChecksumFile(fs, destinationFile, checksum)
+	if err != nil {
+		return err
+	}
+	logger.Info().Msgf("Wrote checksum file %s", utils.DescribeLocation(fs, sidecar))
+	return nil
 }
 
-func InsertFupm(job models.FupmJob, fileName string) {
+var (
+	fupmDBMu sync.Mutex
+	fupmDB   *sql.DB
+)
+
+// openFupmDB returns the connection pool shared by all inserts of the run, opening it on first use
+func openFupmDB() (*sql.DB, error) {
+	fupmDBMu.Lock()
+	defer fupmDBMu.Unlock()
+	if fupmDB != nil {
+		return fupmDB, nil
+	}
+
 	var connectionString string
-	log.Info().Msgf("Initiating oracle SQL connection for job %d", job.JobId)
+	log.Info().Msg("Initiating oracle SQL connection pool")
+
+	// credentials may come from the environment, a secret file or an encrypted value, see utils.ResolveSetting
+	user, err := utils.ResolveSetting("FUPM_ORCL_USR_NAME")
+	if err != nil {
+		return nil, err
+	}
+	password, err := utils.Secret("FUPM_ORCL_PASS")
+	if err != nil {
+		return nil, err
+	}
 
 	if viper.GetString("FUPM_ORCL_SRV_NAME") != "" {
 		log.Info().Msg("Oracle service name found... building connection with service name")
@@ -255,8 +631,8 @@ func InsertFupm(job models.FupmJob, fileName string) {
 			viper.GetString("FUPM_ORCL_HOST"),
 			viper.GetInt("FUPM_ORCL_PORT"),
 			viper.GetString("FUPM_ORCL_SRV_NAME"),
-			viper.GetString("FUPM_ORCL_USR_NAME"),
-			viper.GetString("FUPM_ORCL_PASS"),
+			user,
+			password,
 			nil,
 		)
 	} else {
@@ -268,8 +644,8 @@ func InsertFupm(job models.FupmJob, fileName string) {
 			viper.GetString("FUPM_ORCL_HOST"),
 			viper.GetInt("FUPM_ORCL_PORT"),
 			"",
-			viper.GetString("FUPM_ORCL_USR_NAME"),
-			viper.GetString("FUPM_ORCL_PASS"),
+			user,
+			password,
 			urlOptions,
 		)
 	}
@@ -277,19 +653,39 @@ func InsertFupm(job models.FupmJob, fileName string) {
 	conn, err := sql.Open("oracle", connectionString)
 	if err != nil {
 		log.Error().Err(err).Msgf("Failed to connect to oracle service")
-		return
+		return nil, err
+	}
+	if maxRoutines := viper.GetInt("FUPM_JOB_MAX_ROUTINES"); maxRoutines > 0 {
+		conn.SetMaxOpenConns(maxRoutines)
 	}
-	err = conn.Ping()
+	fupmDB = conn
+	return fupmDB, nil
+}
+
+func closeFupmDB() {
+	fupmDBMu.Lock()
+	defer fupmDBMu.Unlock()
+	if fupmDB != nil {
+		fupmDB.Close()
+		fupmDB = nil
+	}
+}
+
+// InsertFupm runs the job's SQL for the file on the shared pool, ctx bounds the ping and the insert
+func InsertFupm(ctx context.Context, job models.FupmJob, fileName string, logger zerolog.Logger) error {
+	logger.Info().Msgf("Inserting file %s for job %d", fileName, job.JobId)
+	conn, err := openFupmDB()
 	if err != nil {
-		log.Error().Err(err).Msgf("Failed to ping oracle service")
-		return
+		return err
+	}
+	err = conn.PingContext(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Failed to ping oracle service")
+		return err
 	} else {
-		log.Info().Msg("Successfully pinged oracle service")
+		logger.Info().Msg("Successfully pinged oracle service")
 	}
-	defer func() {
-		conn.Close()
-	}()
-	log.Info().Msgf("inserting into fupm with %s", job.FileUploadSqlScript)
+	logger.Info().Msgf("inserting into fupm with %s", job.FileUploadSqlScript)
 	sqlQueryReplacements := map[string]string{
 		"FILENAME": fmt.Sprintf("'%s'", fileName),
 		"LOCATION": job.FileTransferToPath,
@@ -300,85 +696,167 @@ func InsertFupm(job models.FupmJob, fileName string) {
 		query = strings.ReplaceAll(query, key, value)
 	}
 
-	log.Info().Msgf("Executing SQL query: %s", query)
-	_, err = conn.Exec(query)
+	logger.Info().Msgf("Executing SQL query: %s", query)
+	_, err = conn.ExecContext(ctx, query)
 	if err != nil {
-		log.Error().Err(err).Msgf("Failed to execute SQL query: %s", query)
-	} else {
-		log.Info().Msgf("Successfully executed SQL query")
+		logger.Error().Err(err).Msgf("Failed to execute SQL query: %s", query)
+		return err
 	}
+	logger.Info().Msgf("Successfully executed SQL query")
+	return nil
 }
 
-func copyFile(src, dst string) error {
-	log.Debug().Msgf("Copying file from %s to %s", src, dst)
+// copyFile copies src to dst, encrypting on the way when recipients are given.
+// Verification compares the destination with what was written, so it covers encrypted copies too.
+// A copy stopped by ctx removes the partial destination.
+func copyFile(ctx context.Context, srcFs afero.Fs, src string, dstFs afero.Fs, dst string, verify bool, recipients []age.Recipient, logger zerolog.Logger) (int64, error) {
+	logger.Debug().Msgf("Copying file from %s to %s", src, dst)
 
 	// Create destination directory if it doesn't exist
 	destDir := filepath.Dir(dst)
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return fmt.Errorf("failed to create destination directory %s: %w", destDir, err)
+	if err := dstFs.MkdirAll(destDir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create destination directory %s: %w", destDir, err)
 	}
 
 	// Open source file
-	sourceFile, err := os.Open(src)
+	sourceFile, err := srcFs.Open(src)
 	if err != nil {
-		return fmt.Errorf("failed to open source file %s: %w", src, err)
+		return 0, fmt.Errorf("failed to open source file %s: %w", src, err)
 	}
 	defer sourceFile.Close()
 
 	// Create destination file
-	destFile, err := os.Create(dst)
+	destFile, err := dstFs.Create(dst)
 	if err != nil {
-		return fmt.Errorf("failed to create destination file %s: %w", dst, err)
+		return 0, fmt.Errorf("failed to create destination file %s: %w", dst, err)
+	}
+
+	// A failed copy leaves no partial destination behind, uploads are aborted before they store anything
+	discard := func(err error) (int64, error) {
+		if removeErr := dstFs.Remove(dst); removeErr != nil && !os.IsNotExist(removeErr) {
+			logger.Warn().Err(removeErr).Msgf("Unable to remove incomplete destination file %s", dst)
+		}
+		return 0, err
 	}
-	defer destFile.Close()
 
-	// Copy file contents
-	bytesWritten, err := io.Copy(destFile, sourceFile)
+	// Copy file contents, hashing what reaches the destination on the way through
+	written := &hashingWriter{w: destFile, hash: sha256.New()}
+	var contentWriter io.Writer = written
+	var encrypted io.WriteCloser
+	if len(recipients) > 0 {
+		if encrypted, err = utils.EncryptWriter(written, recipients); err != nil {
+			utils.AbortFile(destFile, err)
+			return discard(err)
+		}
+		contentWriter = encrypted
+	}
+	bytesCopied, err := io.Copy(contentWriter, utils.NewContextReader(ctx, sourceFile))
+	if err == nil && encrypted != nil {
+		err = encrypted.Close()
+	}
 	if err != nil {
-		return fmt.Errorf("failed to copy file contents: %w", err)
+		utils.AbortFile(destFile, err)
+		return discard(fmt.Errorf("failed to copy file contents: %w", err))
 	}
 
-	log.Debug().Msgf("Copied %d bytes", bytesWritten)
+	logger.Debug().Msgf("Copied %d bytes, wrote %d bytes", bytesCopied, written.size)
 
 	// Sync to ensure data is written to disk
 	if err := destFile.Sync(); err != nil {
-		return fmt.Errorf("failed to sync destination file: %w", err)
+		utils.AbortFile(destFile, err)
+		return discard(fmt.Errorf("failed to sync destination file: %w", err))
 	}
 
+	// Close before verifying, uploads only complete on close
+	if err := destFile.Close(); err != nil {
+		return discard(fmt.Errorf("failed to close destination file: %w", err))
+	}
+
+	if verify {
+		if err := verifyCopy(dstFs, dst, hex.EncodeToString(written.hash.Sum(nil)), written.size, logger); err != nil {
+			return discard(err)
+		}
+	}
+	return written.size, nil
+}
+
+// hashingWriter hashes and counts everything written through it
+type hashingWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func (h *hashingWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// verifyCopy re-reads the destination and compares it against the size and checksum of what was written
+func verifyCopy(dstFs afero.Fs, dst, expectedChecksum string, expectedSize int64, logger zerolog.Logger) error {
+	destChecksum, destSize, err := utils.FileChecksum(dstFs, dst)
+	if err != nil {
+		return fmt.Errorf("failed to verify destination file: %w", err)
+	}
+	if destSize != expectedSize {
+		return fmt.Errorf("size mismatch after copy to %s: wrote %d bytes, destination has %d bytes", dst, expectedSize, destSize)
+	}
+	if destChecksum != expectedChecksum {
+		return fmt.Errorf("checksum mismatch after copy to %s: wrote %s, destination has %s", dst, expectedChecksum, destChecksum)
+	}
+	logger.Debug().Msgf("Verified %s: %d bytes, sha256 %s", dst, destSize, destChecksum)
 	return nil
 }
 
-func moveFile(src, dst string) error {
-	log.Debug().Msgf("Moving file from %s to %s", src, dst)
+func moveFile(ctx context.Context, srcFs afero.Fs, src string, dstFs afero.Fs, dst string, recipients []age.Recipient, logger zerolog.Logger) (int64, error) {
+	logger.Debug().Msgf("Moving file from %s to %s", src, dst)
 
 	// Create destination directory if it doesn't exist
 	destDir := filepath.Dir(dst)
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return fmt.Errorf("failed to create destination directory %s: %w", destDir, err)
+	if err := dstFs.MkdirAll(destDir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create destination directory %s: %w", destDir, err)
 	}
 
 	// Try to rename first (fastest for same filesystem)
-	if err := os.Rename(src, dst); err != nil {
+	err := fmt.Errorf("source and destination are on different storage")
+	if len(recipients) > 0 {
+		err = fmt.Errorf("the file has to be encrypted")
+	} else if srcFs == dstFs {
+		err = dstFs.Rename(src, dst)
+	}
+	if err != nil {
 		// If rename fails (e.g., different filesystems), copy then delete
-		log.Debug().Msgf("Rename failed, falling back to copy+delete: %v", err)
+		logger.Debug().Msgf("Rename failed, falling back to copy+delete: %v", err)
 
-		if err := copyFile(src, dst); err != nil {
-			return fmt.Errorf("failed to copy file during move operation: %w", err)
+		// Always verify here, the source is about to be deleted
+		bytesWritten, err := copyFile(ctx, srcFs, src, dstFs, dst, true, recipients, logger)
+		if err != nil {
+			return bytesWritten, fmt.Errorf("failed to copy file during move operation, source kept: %w", err)
 		}
 
-		if err := os.Remove(src); err != nil {
-			return fmt.Errorf("failed to remove source file after copy: %w", err)
+		if err := srcFs.Remove(src); err != nil {
+			return bytesWritten, fmt.Errorf("failed to remove source file after copy: %w", err)
 		}
 
-		log.Debug().Msg("Move completed via copy+delete")
-	} else {
-		log.Debug().Msg("Move completed via rename")
+		logger.Debug().Msg("Move completed via copy+delete")
+		return bytesWritten, nil
 	}
 
-	return nil
+	logger.Debug().Msg("Move completed via rename")
+	if info, err := dstFs.Stat(dst); err == nil {
+		return info.Size(), nil
+	}
+	return 0, nil
 }
 
+// load reads the registry file into memory, records already known are kept
 func (cr *CSVRegistry) load() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	defer func() { utils.SetRegistrySize(len(cr.records)) }()
+
 	file, err := os.Open(cr.filePath)
 	if err != nil {
 		log.Info().Msgf("CSV registry file %s doesn't exist yet, will be created", cr.filePath)
@@ -431,55 +909,142 @@ func (cr *CSVRegistry) load() {
 	log.Info().Msgf("Loaded date records for %d dates", len(cr.dateRecords))
 }
 
-func (cr *CSVRegistry) IsProcessed(filename, jobName string) bool {
+// IsProcessed tells whether the job registered the file, or a routine of it holds the file
+func (cr *CSVRegistry) IsProcessed(filename, jobName string, logger zerolog.Logger) bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
 	key := fmt.Sprintf("%s_%s", filename, jobName)
-	isProcessed := cr.records[key]
-	log.Debug().Msgf("Checking IsProcessed: key=%s, result=%t", key, isProcessed)
+	isProcessed := cr.records[key] || cr.inFlight[key]
+	logger.Debug().Msgf("Checking IsProcessed: key=%s, result=%t", key, isProcessed)
 	return isProcessed
 }
 
-func (cr *CSVRegistry) IsProcessedOnDate(filename, date string) bool {
-	// Convert YYYYMMDD to YYYY-MM-DD format for comparison
+// IsProcessedOnDate tells whether any job registered the file on the date, YYYYMMDD or YYYY-MM-DD, or a routine holds it
+func (cr *CSVRegistry) IsProcessedOnDate(filename, date string, logger zerolog.Logger) bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.isProcessedOnDate(filename, date, logger)
+}
+
+// isProcessedOnDate is IsProcessedOnDate, for callers holding the lock
+func (cr *CSVRegistry) isProcessedOnDate(filename, date string, logger zerolog.Logger) bool {
 	originalDate := date
-	if len(date) == 8 {
-		date = fmt.Sprintf("%s-%s-%s", date[:4], date[4:6], date[6:8])
-	}
+	date = registryDay(date)
 
-	log.Debug().Msgf("Checking IsProcessedOnDate: filename=%s, originalDate=%s, convertedDate=%s", filename, originalDate, date)
+	logger.Debug().Msgf("Checking IsProcessedOnDate: filename=%s, originalDate=%s, convertedDate=%s", filename, originalDate, date)
 
+	if cr.dateInFlight[date][filename] > 0 {
+		logger.Debug().Msgf("File %s is being processed for %s", filename, date)
+		return true
+	}
 	if dateMap, exists := cr.dateRecords[date]; exists {
 		isProcessed := dateMap[filename]
-		log.Debug().Msgf("Date map exists for %s, checking filename %s: %t", date, filename, isProcessed)
+		logger.Debug().Msgf("Date map exists for %s, checking filename %s: %t", date, filename, isProcessed)
 		return isProcessed
 	}
 
-	log.Debug().Msgf("No date map found for %s", date)
+	logger.Debug().Msgf("No date map found for %s", date)
 	return false
 }
 
-func (cr *CSVRegistry) AddFile(jobName, filename, newFilePath string) error {
+// registryDay converts YYYYMMDD to the YYYY-MM-DD format of the registry
+func registryDay(date string) string {
+	if len(date) == 8 {
+		return fmt.Sprintf("%s-%s-%s", date[:4], date[4:6], date[6:8])
+	}
+	return date
+}
+
+// RegistryReservation holds a file in flight, from CSVRegistry.Reserve until it is committed or released
+type RegistryReservation struct {
+	registry *CSVRegistry
+	jobName  string
+	filename string
+	key      string
+	date     string
+	done     bool
+}
+
+// Reserve holds the file for the job unless it is registered or held already, checking by job, or by date when a date
+// is given as ProcessOnce jobs do. The check and the hold happen under one lock, so of the routines matching the same
+// file only one gets it. The holder commits the reservation once the file is transferred, or releases it.
+func (cr *CSVRegistry) Reserve(filename, jobName, date string, logger zerolog.Logger) (*RegistryReservation, bool) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	key := fmt.Sprintf("%s_%s", filename, jobName)
+	if date != "" {
+		if cr.isProcessedOnDate(filename, date, logger) {
+			return nil, false
+		}
+		date = registryDay(date)
+	} else {
+		if cr.records[key] || cr.inFlight[key] {
+			logger.Debug().Msgf("Checking Reserve: key=%s is processed or held", key)
+			return nil, false
+		}
+		// the file gets registered on the current date, ProcessOnce jobs see it from now on
+		date = time.Now().Format("2006-01-02")
+	}
+
+	cr.inFlight[key] = true
+	if cr.dateInFlight[date] == nil {
+		cr.dateInFlight[date] = make(map[string]int)
+	}
+	cr.dateInFlight[date][filename]++
+	logger.Debug().Msgf("Reserved %s for %s on %s", filename, jobName, date)
+	return &RegistryReservation{registry: cr, jobName: jobName, filename: filename, key: key, date: date}, true
+}
+
+// Commit adds the file to the registry, then lets go of the reservation
+func (r *RegistryReservation) Commit(newFilePath string, logger zerolog.Logger) error {
+	defer r.Release()
+	return r.registry.AddFile(r.jobName, r.filename, newFilePath, logger)
+}
+
+// Release lets go of the reservation, the file can be picked up again unless it was committed. Releasing twice is harmless.
+func (r *RegistryReservation) Release() {
+	cr := r.registry
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if r.done {
+		return
+	}
+	r.done = true
+	delete(cr.inFlight, r.key)
+	if cr.dateInFlight[r.date][r.filename]--; cr.dateInFlight[r.date][r.filename] <= 0 {
+		delete(cr.dateInFlight[r.date], r.filename)
+	}
+	if len(cr.dateInFlight[r.date]) == 0 {
+		delete(cr.dateInFlight, r.date)
+	}
+}
+
+func (cr *CSVRegistry) AddFile(jobName, filename, newFilePath string, logger zerolog.Logger) error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
 	now := time.Now()
 	dateStr := now.Format("2006-01-02") // YYYY-MM-DD format
 
-	log.Info().Msgf("Adding file to registry: jobName=%s, filename=%s, date=%s", jobName, filename, dateStr)
+	logger.Info().Msgf("Adding file to registry: jobName=%s, filename=%s, date=%s", jobName, filename, dateStr)
 
 	// Add to memory map for quick lookup
 	key := fmt.Sprintf("%s_%s", filename, jobName)
 	cr.records[key] = true
-	log.Debug().Msgf("Added to records map: key=%s", key)
+	logger.Debug().Msgf("Added to records map: key=%s", key)
+	utils.SetRegistrySize(len(cr.records))
 
 	// Add to dateRecords for date-based lookup
 	if cr.dateRecords[dateStr] == nil {
 		cr.dateRecords[dateStr] = make(map[string]bool)
 	}
 	cr.dateRecords[dateStr][filename] = true
-	log.Debug().Msgf("Added to dateRecords: date=%s, filename=%s", dateStr, filename)
+	logger.Debug().Msgf("Added to dateRecords: date=%s, filename=%s", dateStr, filename)
 
 	// Check if file exists and needs header
 	fileExists := true
 	if _, err := os.Stat(cr.filePath); os.IsNotExist(err) {
 		fileExists = false
-		log.Info().Msgf("CSV file %s does not exist, will create with header", cr.filePath)
+		logger.Info().Msgf("CSV file %s does not exist, will create with header", cr.filePath)
 	}
 
 	// Open file for appending
@@ -497,7 +1062,7 @@ func (cr *CSVRegistry) AddFile(jobName, filename, newFilePath string) error {
 		if err := writer.Write(header); err != nil {
 			return fmt.Errorf("failed to write CSV header: %w", err)
 		}
-		log.Info().Msgf("Created new CSV registry file with header: %s", cr.filePath)
+		logger.Info().Msgf("Created new CSV registry file with header: %s", cr.filePath)
 	}
 
 	// Write the record
@@ -508,7 +1073,7 @@ func (cr *CSVRegistry) AddFile(jobName, filename, newFilePath string) error {
 		newFilePath,
 	}
 
-	log.Debug().Msgf("Writing CSV record: %v", record)
+	logger.Debug().Msgf("Writing CSV record: %v", record)
 	if err := writer.Write(record); err != nil {
 		return fmt.Errorf("failed to write CSV record: %w", err)
 	}
@@ -521,9 +1086,9 @@ func (cr *CSVRegistry) AddFile(jobName, filename, newFilePath string) error {
 
 	// Force sync to disk to ensure data persistence
 	if err := file.Sync(); err != nil {
-		log.Warn().Err(err).Msg("Failed to sync CSV file to disk")
+		logger.Warn().Err(err).Msg("Failed to sync CSV file to disk")
 	}
 
-	log.Info().Msgf("Successfully added file to CSV registry: %s", filename)
+	logger.Info().Msgf("Successfully added file to CSV registry: %s", filename)
 	return nil
 }
@@ -0,0 +1,238 @@
+package jobs
+
+import (
+	"CSEFileManager/internal/testfs"
+	"CSEFileManager/models"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/afero"
+)
+
+func TestReserveGivesFileToOneProcessOnceRoutine(t *testing.T) {
+	registry := NewCSVRegistry(filepath.Join(t.TempDir(), "registry.csv"))
+	date := time.Now().Format("20060102")
+
+	var reserved atomic.Int32
+	var wg sync.WaitGroup
+	for _, jobName := range []string{"Job1", "Job2", "Job3", "Job4"} {
+		wg.Add(1)
+		go func(jobName string) {
+			defer wg.Done()
+			reservation, ok := registry.Reserve("data.csv", jobName, date, zerolog.Nop())
+			if !ok {
+				return
+			}
+			reserved.Add(1)
+			if err := reservation.Commit("/target/data.csv", zerolog.Nop()); err != nil {
+				t.Errorf("commit: %v", err)
+			}
+		}(jobName)
+	}
+	wg.Wait()
+
+	if got := reserved.Load(); got != 1 {
+		t.Fatalf("%d routines reserved the file, want 1", got)
+	}
+	if !registry.IsProcessedOnDate("data.csv", date, zerolog.Nop()) {
+		t.Fatal("committed file is not registered on its date")
+	}
+}
+
+func TestReserveHoldsFileUntilReleased(t *testing.T) {
+	registry := NewCSVRegistry(filepath.Join(t.TempDir(), "registry.csv"))
+
+	today := time.Now().Format("20060102")
+	reservation, ok := registry.Reserve("data.csv", "Job1", "", zerolog.Nop())
+	if !ok {
+		t.Fatal("first reservation refused")
+	}
+	if _, ok := registry.Reserve("data.csv", "Job1", "", zerolog.Nop()); ok {
+		t.Fatal("file reserved twice for the same job")
+	}
+	other, ok := registry.Reserve("data.csv", "Job2", "", zerolog.Nop())
+	if !ok {
+		t.Fatal("another job not processing files once was refused the file")
+	}
+	if _, ok := registry.Reserve("data.csv", "Job3", today, zerolog.Nop()); ok {
+		t.Fatal("a ProcessOnce job got a file held for the day")
+	}
+
+	reservation.Release()
+	reservation.Release()
+	if registry.IsProcessed("data.csv", "Job1", zerolog.Nop()) {
+		t.Fatal("released file is still held")
+	}
+	if !registry.IsProcessedOnDate("data.csv", today, zerolog.Nop()) {
+		t.Fatal("file still held by another job is free for the day")
+	}
+	other.Release()
+	if registry.IsProcessedOnDate("data.csv", today, zerolog.Nop()) {
+		t.Fatal("file released by every job is still held for the day")
+	}
+	if _, ok := registry.Reserve("data.csv", "Job1", "", zerolog.Nop()); !ok {
+		t.Fatal("released file cannot be reserved again")
+	}
+}
+
+// lossyFs silently drops the last byte of every write to the files it creates, like a faulty disk or mount
+type lossyFs struct {
+	afero.Fs
+}
+
+func (fs lossyFs) Create(name string) (afero.File, error) {
+	file, err := fs.Fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return lossyFile{file}, nil
+}
+
+type lossyFile struct {
+	afero.File
+}
+
+func (f lossyFile) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := f.File.Write(p[:len(p)-1]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+const transferContent = "ID,AMOUNT\n1,100\n2,250\n"
+
+func newSourceFs(t *testing.T) afero.Fs {
+	t.Helper()
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/in/data.csv", []byte(transferContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func assertContent(t *testing.T, fs afero.Fs, name, want string) {
+	t.Helper()
+	content, err := afero.ReadFile(fs, name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if string(content) != want {
+		t.Fatalf("%s holds %q, want %q", name, content, want)
+	}
+}
+
+func assertMissing(t *testing.T, fs afero.Fs, name, why string) {
+	t.Helper()
+	if exists, _ := afero.Exists(fs, name); exists {
+		t.Fatalf("%s exists: %s", name, why)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		srcFs, dstFs := newSourceFs(t), afero.NewMemMapFs()
+		written, err := copyFile(context.Background(), srcFs, "/in/data.csv", dstFs, "/out/data.csv", verify, nil, zerolog.Nop())
+		if err != nil {
+			t.Fatalf("verify=%t: %v", verify, err)
+		}
+		if written != int64(len(transferContent)) {
+			t.Fatalf("verify=%t: wrote %d bytes, want %d", verify, written, len(transferContent))
+		}
+		assertContent(t, dstFs, "/out/data.csv", transferContent)
+		assertContent(t, srcFs, "/in/data.csv", transferContent)
+	}
+}
+
+func TestCopyFileVerifyMismatchRemovesDestination(t *testing.T) {
+	srcFs, dstFs := newSourceFs(t), afero.NewMemMapFs()
+	_, err := copyFile(context.Background(), srcFs, "/in/data.csv", lossyFs{dstFs}, "/out/data.csv", true, nil, zerolog.Nop())
+	if err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Fatalf("got %v, want a mismatch", err)
+	}
+	assertMissing(t, dstFs, "/out/data.csv", "the corrupt copy was kept")
+}
+
+func TestCopyFilePartialWriteRemovesDestination(t *testing.T) {
+	srcFs, dstFs := newSourceFs(t), afero.NewMemMapFs()
+	_, err := copyFile(context.Background(), srcFs, "/in/data.csv", testfs.FailingFs{Fs: dstFs, Limit: 5}, "/out/data.csv", false, nil, zerolog.Nop())
+	if !errors.Is(err, testfs.ErrDiskFull) {
+		t.Fatalf("got %v, want %v", err, testfs.ErrDiskFull)
+	}
+	assertMissing(t, dstFs, "/out/data.csv", "the partial copy was kept")
+}
+
+func TestMoveFile(t *testing.T) {
+	t.Run("same storage", func(t *testing.T) {
+		fs := newSourceFs(t)
+		if _, err := moveFile(context.Background(), fs, "/in/data.csv", fs, "/out/data.csv", nil, zerolog.Nop()); err != nil {
+			t.Fatal(err)
+		}
+		assertContent(t, fs, "/out/data.csv", transferContent)
+		assertMissing(t, fs, "/in/data.csv", "the source was not moved")
+	})
+	t.Run("across storages", func(t *testing.T) {
+		srcFs, dstFs := newSourceFs(t), afero.NewMemMapFs()
+		written, err := moveFile(context.Background(), srcFs, "/in/data.csv", dstFs, "/out/data.csv", nil, zerolog.Nop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written != int64(len(transferContent)) {
+			t.Fatalf("wrote %d bytes, want %d", written, len(transferContent))
+		}
+		assertContent(t, dstFs, "/out/data.csv", transferContent)
+		assertMissing(t, srcFs, "/in/data.csv", "the source was not deleted")
+	})
+}
+
+func TestMoveFileKeepsSourceWhenCopyFails(t *testing.T) {
+	for name, wrap := range map[string]func(afero.Fs) afero.Fs{
+		"verify mismatch": func(fs afero.Fs) afero.Fs { return lossyFs{fs} },
+		"partial write":   func(fs afero.Fs) afero.Fs { return testfs.FailingFs{Fs: fs, Limit: 5} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			srcFs, dstFs := newSourceFs(t), afero.NewMemMapFs()
+			if _, err := moveFile(context.Background(), srcFs, "/in/data.csv", wrap(dstFs), "/out/data.csv", nil, zerolog.Nop()); err == nil {
+				t.Fatal("move succeeded")
+			}
+			assertContent(t, srcFs, "/in/data.csv", transferContent)
+			assertMissing(t, dstFs, "/out/data.csv", "the failed copy was kept")
+		})
+	}
+}
+
+func TestProcessJobFileFinishesOnStop(t *testing.T) {
+	srcFs, dstFs := newSourceFs(t), afero.NewMemMapFs()
+	registry := NewCSVRegistry(filepath.Join(t.TempDir(), "registry.csv"))
+	transfer := fupmTransfer{
+		job:          models.FupmJob{JobId: 1, FileTransferType: "COPY"},
+		jobName:      "Job_1_COPY",
+		transferType: "COPY",
+		sourceFs:     srcFs,
+		targetFs:     dstFs,
+		targetRoot:   "/out",
+		logger:       zerolog.Nop(),
+	}
+	// stopped after the file was handed over, it is transferred and registered all the same
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report := models.NewRunReport("FUPM")
+	processJobFile(ctx, transfer, "/in/data.csv", registry, report)
+
+	if report.Counts[models.FileStatusTransferred] != 1 {
+		t.Fatalf("counts %v, want 1 transferred", report.Counts)
+	}
+	assertContent(t, dstFs, "/out/data.csv", transferContent)
+	if !registry.IsProcessed("data.csv", "Job_1_COPY", zerolog.Nop()) {
+		t.Fatal("transferred file not registered")
+	}
+}
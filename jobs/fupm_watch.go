@@ -0,0 +1,322 @@
+package jobs
+
+import (
+	"CSEFileManager/models"
+	"CSEFileManager/utils"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultWatchDebounce  = 2 * time.Second
+	defaultWatchReconcile = 5 * time.Minute
+)
+
+// watchedFupmJob is a job held by the watcher, with the files its events announced that are still settling
+type watchedFupmJob struct {
+	job     models.FupmJob
+	watched bool                 // false when no events come in for its source, it only gets reconciliations
+	pending map[string]time.Time // by the time of their last event
+}
+
+// watchBatchJob is the share of a job in a batch: its settled files, or when reconciling the files still settling
+type watchBatchJob struct {
+	job      models.FupmJob
+	files    []string
+	settling map[string]bool
+}
+
+// WatchFupmJobs transfers the files of every job as they land in its FileTransferFromPath, until ctx is cancelled.
+// Create and write events matching the date resolved pattern of a job are transferred once the file has been quiet
+// for FUPM_WATCH_DEBOUNCE, and every FUPM_WATCH_RECONCILE the pattern is globbed for files whose events were missed.
+// Every batch of files is reported to onBatch as a run of its own, an error means the configuration is invalid.
+//
+// Batches run one at a time beside the event loop, events keep being collected while a batch transfers.
+// Close-write events are not portable and fsnotify does not deliver them, so a file is only known to be complete
+// by its quiet time: writers pausing longer than the debounce should write under a name outside the pattern
+// and rename the file into it once done.
+func WatchFupmJobs(ctx context.Context, appFlags models.Args, onBatch func(*models.RunReport)) error {
+	AppFlags = appFlags
+	log.Info().Msg("Starting fupm watcher..")
+	jobList, maxRoutines, err := loadFupmJobs()
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("FUPM_WATCH_DEBOUNCE=%s", viper.GetString("FUPM_WATCH_DEBOUNCE"))
+	log.Info().Msgf("FUPM_WATCH_RECONCILE=%s", viper.GetString("FUPM_WATCH_RECONCILE"))
+	debounce, err := watchDuration("FUPM_WATCH_DEBOUNCE", defaultWatchDebounce)
+	if err != nil {
+		return err
+	}
+	reconcile, err := watchDuration("FUPM_WATCH_RECONCILE", defaultWatchReconcile)
+	if err != nil {
+		return err
+	}
+
+	csvFilePath := viper.GetString("CSV_REGISTRY_PATH")
+	if csvFilePath == "" {
+		csvFilePath = "./processed_files.csv" // Default path
+	}
+	registry := NewCSVRegistry(csvFilePath)
+	log.Info().Msgf("Using CSV registry: %s", csvFilePath)
+	defer closeFupmDB()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to start the file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// the locks are held while the jobs are watched, scheduled runs of the same jobs skip them meanwhile
+	startup := models.NewRunReport("FUPM")
+	var watched []*watchedFupmJob
+	for _, job := range jobList {
+		lock, ok := lockJob(ctx, startup, job.JobId)
+		if !ok {
+			continue
+		}
+		defer lock.Release()
+
+		w := &watchedFupmJob{job: job, pending: make(map[string]time.Time)}
+		logger := log.With().Int("job_id", job.JobId).Logger()
+		if strings.ToUpper(job.FileTransferType) == TransferTypeSftpGet {
+			logger.Warn().Msgf("job %d reads from sftp, its files are picked up every %s only", job.JobId, reconcile)
+		} else if err := watcher.Add(job.FileTransferFromPath); err != nil {
+			logger.Warn().Err(err).Msgf("unable to watch %s, files of job %d are picked up every %s only", job.FileTransferFromPath, job.JobId, reconcile)
+		} else {
+			w.watched = true
+			logger.Info().Msgf("watching %s for job %d", job.FileTransferFromPath, job.JobId)
+		}
+		watched = append(watched, w)
+	}
+	if len(startup.Jobs) > 0 {
+		startup.Finish()
+		onBatch(startup)
+	}
+	if len(watched) == 0 {
+		return fmt.Errorf("no FUPM job left to watch, every job is locked or failed to lock")
+	}
+
+	templates := make(map[int]string)
+	for _, job := range jobList {
+		templates[job.JobId] = job.NotifyTemplate
+	}
+	fileSlots := make(chan struct{}, maxRoutines)
+	batchDone := make(chan struct{})
+	busy, reconcileDue := false, false
+	runBatch := func(reconciling bool) {
+		if busy {
+			// the pending files wait for the next settle tick, a reconciliation for the end of the batch
+			reconcileDue = reconcileDue || reconciling
+			return
+		}
+		now := time.Now()
+		batch := collectWatchBatch(watched, reconciling, now, debounce)
+		if len(batch) == 0 {
+			return
+		}
+		busy = true
+		go func() {
+			defer func() { batchDone <- struct{}{} }()
+			report := runWatchBatch(ctx, batch, reconciling, now, debounce, registry, fileSlots)
+			if len(report.Jobs) == 0 {
+				return
+			}
+			utils.NotifyRunOutcome(report, templates)
+			onBatch(report)
+		}()
+	}
+
+	// files that landed while nothing watched are picked up right away
+	runBatch(true)
+	settle := time.NewTicker(debounce / 2)
+	defer settle.Stop()
+	reconciliation := time.NewTicker(reconcile)
+	defer reconciliation.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if busy {
+				log.Info().Msg("fupm watcher stopping after the batch in progress")
+				<-batchDone
+			}
+			log.Info().Msg("fupm watcher stopped")
+			return nil
+		case <-batchDone:
+			busy = false
+			if reconcileDue {
+				reconcileDue = false
+				runBatch(true)
+			}
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			collectWatchEvent(watched, event, time.Now())
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warn().Err(err).Msg("file watcher error, events may have been missed, reconciling now")
+			runBatch(true)
+		case <-settle.C:
+			runBatch(false)
+		case <-reconciliation.C:
+			runBatch(true)
+		}
+	}
+}
+
+// collectWatchEvent marks the file of a create or write event pending for the watched jobs it matches
+func collectWatchEvent(watched []*watchedFupmJob, event fsnotify.Event, now time.Time) {
+	// a file renamed into the folder comes as a create, the write events of a file being filled keep it pending
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+		return
+	}
+	for _, w := range watched {
+		if w.watched && w.matches(event.Name) {
+			w.pending[event.Name] = now
+		}
+	}
+}
+
+// watchDuration reads a positive duration setting, falling back to the given default when unset
+func watchDuration(key string, fallback time.Duration) (time.Duration, error) {
+	if !viper.IsSet(key) || viper.GetString(key) == "" {
+		return fallback, nil
+	}
+	duration, err := utils.ParseDuration(viper.GetString(key))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %s", key, duration)
+	}
+	return duration, nil
+}
+
+// matches tells whether the file is one of the job, its pattern being resolved for the current date
+func (w *watchedFupmJob) matches(file string) bool {
+	// resolved on every event, its debug lines would drown the log
+	pattern, _, err := resolveFupmPattern(w.job, AppFlags.Arg1, time.Now(), zerolog.Nop())
+	if err != nil {
+		return false
+	}
+	matched, _ := filepath.Match(filepath.Join(w.job.FileTransferFromPath, pattern), file)
+	return matched
+}
+
+// settled takes the pending files quiet for the debounce out of the job, dropping those already gone
+func (w *watchedFupmJob) settled(now time.Time, debounce time.Duration) []string {
+	var files []string
+	for file, lastEvent := range w.pending {
+		if now.Sub(lastEvent) < debounce {
+			continue
+		}
+		delete(w.pending, file)
+		if _, err := utils.LocalFs.Stat(file); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// collectWatchBatch takes the settled files out of the watched jobs, or when reconciling every job along with
+// the files still settling, which the reconciliation leaves to a later batch. It runs on the event loop.
+func collectWatchBatch(watched []*watchedFupmJob, reconciling bool, now time.Time, debounce time.Duration) []watchBatchJob {
+	var batch []watchBatchJob
+	for _, w := range watched {
+		if !reconciling {
+			if files := w.settled(now, debounce); len(files) > 0 {
+				batch = append(batch, watchBatchJob{job: w.job, files: files})
+			}
+			continue
+		}
+		settling := make(map[string]bool, len(w.pending))
+		for file := range w.pending {
+			settling[file] = true
+		}
+		batch = append(batch, watchBatchJob{job: w.job, settling: settling})
+	}
+	return batch
+}
+
+// runWatchBatch transfers the files of the batch, or when reconciling every file matching the pattern of its jobs
+// that is not registered yet. Files still settling, by their events or their modification time, wait for a later batch.
+func runWatchBatch(ctx context.Context, batch []watchBatchJob, reconciling bool, now time.Time, debounce time.Duration,
+	registry *CSVRegistry, fileSlots chan struct{}) *models.RunReport {
+	report := models.NewRunReport("FUPM")
+	report.OnFile = utils.ObserveFileResult
+	defer report.Finish()
+
+	// another process may have registered files since the last batch
+	registry.load()
+	var wg sync.WaitGroup
+	for _, b := range batch {
+		wg.Add(1)
+		go func(b watchBatchJob) {
+			defer wg.Done()
+			ctx, cancel := utils.WithTimeout(ctx, b.job.JobTimeout)
+			defer cancel()
+
+			transfer, pattern, ok := openFupmTransfer(b.job, report)
+			if !ok {
+				return
+			}
+			defer transfer.Close()
+			files := b.files
+			if reconciling {
+				files = reconcileFupmJob(ctx, transfer, pattern, b.settling, now, debounce, registry, report)
+			}
+			if len(files) == 0 {
+				return
+			}
+			report.AddMatched(b.job.JobId, len(files))
+			transfer.logger.Info().Msgf("Found %d new files for job %d", len(files), b.job.JobId)
+			// the glob sorts its files, announced ones keep the same order
+			sort.Strings(files)
+			transferFiles(ctx, transfer, files, registry, fileSlots, report)
+		}(b)
+	}
+	wg.Wait()
+	return report
+}
+
+// reconcileFupmJob globs the pattern of the job for the files its events missed: not registered and no longer written to
+func reconcileFupmJob(ctx context.Context, transfer *fupmTransfer, pattern string, settling map[string]bool, now time.Time,
+	debounce time.Duration, registry *CSVRegistry, report *models.RunReport) []string {
+	job := transfer.job
+	fullPattern := filepath.Join(job.FileTransferFromPath, pattern)
+	matchingFiles, err := utils.GlobContext(ctx, transfer.sourceFs, fullPattern)
+	if err != nil {
+		transfer.logger.Error().Err(err).Msgf("Error finding files with pattern %s", fullPattern)
+		report.JobFailed(job.JobId, err)
+		return nil
+	}
+
+	var files []string
+	for _, file := range matchingFiles {
+		if settling[file] || transfer.processed(registry, filepath.Base(file)) {
+			continue
+		}
+		info, err := transfer.sourceFs.Stat(file)
+		if err != nil || info.IsDir() || now.Sub(info.ModTime()) < debounce {
+			continue
+		}
+		files = append(files, file)
+	}
+	return files
+}
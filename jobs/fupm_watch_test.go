@@ -0,0 +1,121 @@
+package jobs
+
+import (
+	"CSEFileManager/models"
+	"CSEFileManager/utils"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/spf13/afero"
+)
+
+func watchTestJob(t *testing.T) *watchedFupmJob {
+	t.Helper()
+	return &watchedFupmJob{
+		job:     models.FupmJob{JobId: 1, FilePattern: "DATA_YYYYMMDD_*.csv", FileTransferType: "COPY", FileTransferFromPath: "/in"},
+		watched: true,
+		pending: make(map[string]time.Time),
+	}
+}
+
+func TestCollectWatchEventFiltersByPattern(t *testing.T) {
+	job, unwatched := watchTestJob(t), watchTestJob(t)
+	unwatched.watched = false
+	today := "/in/DATA_" + time.Now().Format("20060102") + "_1.csv"
+	now := time.Now()
+
+	for _, event := range []fsnotify.Event{
+		{Name: today, Op: fsnotify.Create},
+		{Name: "/in/DATA_19990101_1.csv", Op: fsnotify.Create},
+		{Name: "/in/other.csv", Op: fsnotify.Write},
+		{Name: "/in/DATA_" + time.Now().Format("20060102") + "_2.csv", Op: fsnotify.Remove},
+		{Name: "/in/DATA_" + time.Now().Format("20060102") + "_3.csv", Op: fsnotify.Chmod},
+		{Name: "/elsewhere/DATA_" + time.Now().Format("20060102") + "_4.csv", Op: fsnotify.Create},
+	} {
+		collectWatchEvent([]*watchedFupmJob{job, unwatched}, event, now)
+	}
+
+	if len(job.pending) != 1 || job.pending[today] != now {
+		t.Fatalf("pending %v, want only %s", job.pending, today)
+	}
+	if len(unwatched.pending) != 0 {
+		t.Fatalf("unwatched job got events: %v", unwatched.pending)
+	}
+}
+
+func TestSettledWaitsForDebounce(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	previous := utils.LocalFs
+	utils.LocalFs = fs
+	t.Cleanup(func() { utils.LocalFs = previous })
+	if err := afero.WriteFile(fs, "/in/a.csv", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := watchTestJob(t)
+	lastEvent := time.Now()
+	w.pending["/in/a.csv"] = lastEvent
+	w.pending["/in/gone.csv"] = lastEvent
+
+	if files := w.settled(lastEvent.Add(time.Second), 2*time.Second); len(files) != 0 || len(w.pending) != 2 {
+		t.Fatalf("settled %v before the debounce, pending %v", files, w.pending)
+	}
+	// a new event restarts the wait
+	w.pending["/in/a.csv"] = lastEvent.Add(time.Second)
+	if files := w.settled(lastEvent.Add(2*time.Second), 2*time.Second); len(files) != 0 || len(w.pending) != 1 {
+		t.Fatalf("settled %v although written a second ago, pending %v", files, w.pending)
+	}
+	if files := w.settled(lastEvent.Add(3*time.Second), 2*time.Second); len(files) != 1 || files[0] != "/in/a.csv" || len(w.pending) != 0 {
+		t.Fatalf("settled %v, pending %v", files, w.pending)
+	}
+
+	// collected for a batch, the files leave the pending set
+	w.pending["/in/a.csv"] = lastEvent
+	batch := collectWatchBatch([]*watchedFupmJob{w}, false, lastEvent.Add(3*time.Second), 2*time.Second)
+	if len(batch) != 1 || len(batch[0].files) != 1 || len(w.pending) != 0 {
+		t.Fatalf("batch %+v, pending %v", batch, w.pending)
+	}
+}
+
+func TestReconcileFupmJobTakesMissedFilesOnly(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	now := time.Now()
+	old := now.Add(-time.Minute)
+	for name, modTime := range map[string]time.Time{
+		"missed.csv":     old,
+		"registered.csv": old,
+		"settling.csv":   old,
+		"fresh.csv":      now,
+		"other.txt":      old,
+	} {
+		if err := afero.WriteFile(fs, filepath.Join("/in", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Chtimes(filepath.Join("/in", name), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.MkdirAll("/in/folder.csv", 0755); err != nil {
+		t.Fatal(err)
+	}
+	registry := NewCSVRegistry(filepath.Join(t.TempDir(), "registry.csv"))
+	reservation, _ := registry.Reserve("registered.csv", "Job_1_COPY", "", zerolog.Nop())
+	if err := reservation.Commit("/out/registered.csv", zerolog.Nop()); err != nil {
+		t.Fatal(err)
+	}
+	transfer := &fupmTransfer{
+		job:      models.FupmJob{JobId: 1, FileTransferType: "COPY", FileTransferFromPath: "/in"},
+		jobName:  "Job_1_COPY",
+		sourceFs: fs,
+		logger:   zerolog.Nop(),
+	}
+
+	report := models.NewRunReport("FUPM")
+	files := reconcileFupmJob(context.Background(), transfer, "*.csv", map[string]bool{"/in/settling.csv": true}, now, 2*time.Second, registry, report)
+	if len(files) != 1 || files[0] != "/in/missed.csv" {
+		t.Fatalf("reconciled %v, want /in/missed.csv only", files)
+	}
+}
@@ -0,0 +1,25 @@
+package jobs
+
+import (
+	"CSEFileManager/models"
+	"CSEFileManager/utils"
+	"context"
+	"errors"
+)
+
+// lockJob takes the single instance lock of a job, a job that cannot be locked is recorded in the report and skipped
+func lockJob(ctx context.Context, report *models.RunReport, jobId int) (*utils.JobLock, bool) {
+	lock, err := utils.AcquireJobLock(ctx, report.JobType, jobId)
+	if err == nil {
+		return lock, true
+	}
+	logger := utils.JobLogger(report, jobId, "")
+	if errors.Is(err, utils.ErrJobLocked) {
+		logger.Warn().Msgf("skipping %s job %d: %v", report.JobType, jobId, err)
+		report.JobLocked(jobId, err.Error())
+	} else {
+		logger.Error().Err(err).Msgf("unable to lock %s job %d", report.JobType, jobId)
+		report.JobFailed(jobId, err)
+	}
+	return nil, false
+}
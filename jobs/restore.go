@@ -0,0 +1,212 @@
+package jobs
+
+import (
+	"CSEFileManager/models"
+	"CSEFileManager/utils"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// RunRestore fetches an archive (arg1, local path or s3 uri) into a folder (arg2, defaults to the current one),
+// decrypting .age files with RESTORE_IDENTITY_PATH and extracting zips. Existing files are only replaced
+// with RESTORE_OVERWRITE, files are written under a temporary name and renamed once complete.
+func RunRestore(ctx context.Context, appFlags models.Args) (*models.RunReport, error) {
+	log.Info().Msg("Starting restore..")
+	if appFlags.Arg1 == "" {
+		return nil, fmt.Errorf("no archive given, pass the archive path in arg1")
+	}
+	report := models.NewRunReport("RESTORE")
+	report.OnFile = utils.ObserveFileResult
+	defer report.Finish()
+	logger := utils.JobLogger(report, 1, "").With().Str("file", appFlags.Arg1).Logger()
+	outputDir := appFlags.Arg2
+	if outputDir == "" {
+		outputDir = "."
+	}
+	logger.Info().Msgf("Restoring %s to %s", appFlags.Arg1, outputDir)
+
+	start := time.Now()
+	report.AddMatched(1, 1)
+	restored, err := restoreArchive(ctx, appFlags.Arg1, outputDir, viper.GetBool("RESTORE_OVERWRITE"), logger)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Failed to restore %s", appFlags.Arg1)
+		report.AddFailure(1, appFlags.Arg1, "restore", err, 0, 0, start)
+	}
+	// the files extracted before a failure are complete, they are reported along with it
+	for _, file := range restored {
+		logger.Info().Msgf("Restored file %s", file)
+		var size int64
+		if info, err := os.Stat(file); err == nil {
+			size = info.Size()
+		}
+		report.AddFile(1, file, models.FileStatusRestored, nil, 0, size, start)
+	}
+	if err == nil {
+		logger.Info().Msg("Restore completed")
+	}
+	return report, nil
+}
+
+func restoreArchive(ctx context.Context, archive, outputDir string, overwrite bool, logger zerolog.Logger) ([]string, error) {
+	sourceFs, sourcePath, err := utils.ResolveStorage(archive)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory %s: %w", outputDir, err)
+	}
+
+	sourceFile, err := sourceFs.Open(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive %s: %w", archive, err)
+	}
+	defer sourceFile.Close()
+
+	content := utils.NewContextReader(ctx, sourceFile)
+	name := filepath.Base(sourcePath)
+	if strings.HasSuffix(name, utils.EncryptedFileExtension) {
+		if content, err = decryptArchive(archive, content); err != nil {
+			return nil, err
+		}
+		name = strings.TrimSuffix(name, utils.EncryptedFileExtension)
+		logger.Info().Msgf("Decrypting %s", archive)
+	}
+
+	if !strings.HasSuffix(name, ".zip") {
+		target := filepath.Join(outputDir, name)
+		if err := writeLocalFile(target, content, overwrite); err != nil {
+			return nil, err
+		}
+		return []string{target}, nil
+	}
+
+	// zip needs random access, so the (decrypted) archive is written out first
+	fetched, err := os.CreateTemp(outputDir, ".restore-*.zip")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a temporary file in %s: %w", outputDir, err)
+	}
+	defer func() {
+		if err := os.Remove(fetched.Name()); err != nil {
+			logger.Warn().Err(err).Msgf("Unable to remove intermediate archive %s", fetched.Name())
+		}
+	}()
+	_, err = io.Copy(fetched, content)
+	if closeErr := fetched.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", fetched.Name(), err)
+	}
+	return extractZip(ctx, fetched.Name(), outputDir, overwrite, logger)
+}
+
+// decryptArchive decrypts the content of an .age archive with the identities in RESTORE_IDENTITY_PATH
+func decryptArchive(archive string, content io.Reader) (io.Reader, error) {
+	identityPath := viper.GetString("RESTORE_IDENTITY_PATH")
+	if identityPath == "" {
+		return nil, fmt.Errorf("%s is encrypted but RESTORE_IDENTITY_PATH is not configured", archive)
+	}
+	identities, err := utils.LoadIdentities(identityPath)
+	if err != nil {
+		return nil, err
+	}
+	return utils.DecryptReader(content, identities)
+}
+
+// writeLocalFile writes the content under a temporary name next to path and renames it into place once complete,
+// nothing is left behind on error. An existing file is only replaced when overwrite is set.
+func writeLocalFile(path string, content io.Reader, overwrite bool) error {
+	if err := checkRestoreTarget(path, overwrite); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	partial := file.Name()
+	_, err = io.Copy(file, content)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	// checked again, the file may have appeared while this one was written
+	if err := checkRestoreTarget(path, overwrite); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("failed to rename %s to %s: %w", partial, path, err)
+	}
+	return nil
+}
+
+// checkRestoreTarget refuses an existing file unless it may be overwritten
+func checkRestoreTarget(path string, overwrite bool) error {
+	if overwrite {
+		return nil
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return fmt.Errorf("%s already exists, set RESTORE_OVERWRITE=true to replace it", path)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to check %s: %w", path, err)
+	}
+	return nil
+}
+
+// extractZip writes the files of the zip into the output folder, refusing before writing any
+// when one of them exists and may not be overwritten. Returns the files extracted, before a failure too.
+func extractZip(ctx context.Context, zipPath, outputDir string, overwrite bool, logger zerolog.Logger) ([]string, error) {
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip %s: %w", zipPath, err)
+	}
+	defer reader.Close()
+
+	var entries []*zip.File
+	for _, entry := range reader.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		// archives only hold base names, never write outside the output folder
+		if err := checkRestoreTarget(filepath.Join(outputDir, filepath.Base(entry.Name)), overwrite); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	var restored []string
+	for _, entry := range entries {
+		target := filepath.Join(outputDir, filepath.Base(entry.Name))
+		entryReader, err := entry.Open()
+		if err != nil {
+			return restored, fmt.Errorf("failed to open %s in %s: %w", entry.Name, zipPath, err)
+		}
+		err = writeLocalFile(target, utils.NewContextReader(ctx, entryReader), overwrite)
+		entryReader.Close()
+		if err != nil {
+			return restored, err
+		}
+		if entry.Comment != "" {
+			logger.Info().Msgf("%s was archived from %s", entry.Name, entry.Comment)
+		}
+		restored = append(restored, target)
+	}
+	return restored, nil
+}
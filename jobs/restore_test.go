@@ -0,0 +1,153 @@
+package jobs
+
+import (
+	"CSEFileManager/models"
+	"CSEFileManager/utils"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zip"
+	"github.com/spf13/viper"
+)
+
+// writeEncryptedArchive zips the files and encrypts the zip to a new identity, whose file it returns with the archive
+func writeEncryptedArchive(t *testing.T, files map[string]string) (string, string) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	identityPath := filepath.Join(dir, "identity.txt")
+	if err := os.WriteFile(identityPath, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := filepath.Join(dir, "app.log.zip"+utils.EncryptedFileExtension)
+	archive, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	encrypted, err := utils.EncryptWriter(archive, []age.Recipient{identity.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipWriter := zip.NewWriter(encrypted)
+	for name, content := range files {
+		entry, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := entry.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := encrypted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath, identityPath
+}
+
+func runRestore(t *testing.T, archive, outputDir string, overwrite bool) *models.RunReport {
+	t.Helper()
+	viper.Set("RESTORE_OVERWRITE", overwrite)
+	t.Cleanup(func() { viper.Set("RESTORE_OVERWRITE", nil) })
+	report, err := RunRestore(context.Background(), models.Args{Arg1: archive, Arg2: outputDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func assertFolder(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("%s holds %d files, want %d: %v", dir, len(entries), len(want), entries)
+	}
+	for name, content := range want {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(got) != content {
+			t.Fatalf("%s holds %q, %v, want %q", name, got, err, content)
+		}
+	}
+}
+
+func TestRestoreEncryptedArchive(t *testing.T) {
+	files := map[string]string{"app.log": "line 1\nline 2\n", "app.log.1": "older line\n"}
+	archive, identityPath := writeEncryptedArchive(t, files)
+	viper.Set("RESTORE_IDENTITY_PATH", identityPath)
+	t.Cleanup(func() { viper.Set("RESTORE_IDENTITY_PATH", nil) })
+	outputDir := t.TempDir()
+
+	report := runRestore(t, archive, outputDir, false)
+	if report.Counts[models.FileStatusRestored] != 2 {
+		t.Fatalf("counts %v, want 2 restored", report.Counts)
+	}
+	assertFolder(t, outputDir, files)
+
+	// restored again, the files in place are kept and nothing else is written
+	if err := os.WriteFile(filepath.Join(outputDir, "app.log"), []byte("edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report = runRestore(t, archive, outputDir, false)
+	if result := report.Jobs[0].Files[0]; result.Status != models.FileStatusFailed || !strings.Contains(result.Error, "already exists") {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	assertFolder(t, outputDir, map[string]string{"app.log": "edited\n", "app.log.1": files["app.log.1"]})
+
+	report = runRestore(t, archive, outputDir, true)
+	if report.Counts[models.FileStatusRestored] != 2 {
+		t.Fatalf("counts %v, want 2 restored over the existing files", report.Counts)
+	}
+	assertFolder(t, outputDir, files)
+}
+
+func TestRestoreWithWrongIdentityWritesNothing(t *testing.T) {
+	archive, _ := writeEncryptedArchive(t, map[string]string{"app.log": "line\n"})
+	_, otherIdentity := writeEncryptedArchive(t, map[string]string{})
+	viper.Set("RESTORE_IDENTITY_PATH", otherIdentity)
+	t.Cleanup(func() { viper.Set("RESTORE_IDENTITY_PATH", nil) })
+	outputDir := t.TempDir()
+
+	report := runRestore(t, archive, outputDir, false)
+	if report.Counts[models.FileStatusFailed] != 1 {
+		t.Fatalf("counts %v, want the restore failed", report.Counts)
+	}
+	assertFolder(t, outputDir, map[string]string{})
+}
+
+func TestWriteLocalFileRemovesPartialFile(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "app.log")
+	content := &failingReader{data: "partial content"}
+	if err := writeLocalFile(target, content, true); err == nil {
+		t.Fatal("write of a failing reader succeeded")
+	}
+	assertFolder(t, dir, map[string]string{})
+}
+
+// failingReader gives its data then fails, like a stream cut short
+type failingReader struct {
+	data string
+	read bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.read {
+		return 0, os.ErrDeadlineExceeded
+	}
+	r.read = true
+	return copy(p, r.data), nil
+}
@@ -0,0 +1,315 @@
+package jobs
+
+import (
+	"CSEFileManager/models"
+	"CSEFileManager/utils"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// searchOutput receives the hits of a search, one per line, whatever the log level
+var searchOutput io.Writer = os.Stdout
+
+// searchQuery is what a SEARCH run looks for, matches counts the log lines found so far
+type searchQuery struct {
+	name       string         // file name, path or glob of the original file, empty for any
+	content    *regexp.Regexp // log lines to find in the archives, nil only lists the archives
+	from, to   time.Time      // range of the file dates, zero is open
+	maxMatches int
+	matches    int
+}
+
+// RunSearch finds the archives holding a file (arg1: a name, a path or a glob, empty for any) through the index
+// at the root of the archives. Given a regex in arg2 it also greps the log lines of those archives.
+// The archives found, or the matching lines, are printed to stdout rather than logged.
+func RunSearch(ctx context.Context, appFlags models.Args) (*models.RunReport, error) {
+	log.Info().Msg("Starting search..")
+	log.Info().Msgf("SEARCH_PATH=%s", viper.GetString("SEARCH_PATH"))
+	log.Info().Msgf("SEARCH_FROM=%s", viper.GetString("SEARCH_FROM"))
+	log.Info().Msgf("SEARCH_TO=%s", viper.GetString("SEARCH_TO"))
+	log.Info().Msgf("SEARCH_MAX_MATCHES=%s", viper.GetString("SEARCH_MAX_MATCHES"))
+	log.Info().Msgf("SEARCH_REBUILD_INDEX=%s", viper.GetString("SEARCH_REBUILD_INDEX"))
+
+	query := &searchQuery{name: appFlags.Arg1, maxMatches: 1000}
+	if appFlags.Arg2 != "" {
+		content, err := regexp.Compile(appFlags.Arg2)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content regex in arg2: %w", err)
+		}
+		query.content = content
+	}
+	if query.name == "" && query.content == nil {
+		return nil, fmt.Errorf("nothing to search, pass a file name in arg1 and/or a content regex in arg2")
+	}
+	if query.name != "" {
+		if _, err := filepath.Match(query.name, ""); err != nil {
+			return nil, fmt.Errorf("invalid file name pattern %s in arg1: %w", query.name, err)
+		}
+	}
+	var err error
+	if query.from, err = parseSearchTime(viper.GetString("SEARCH_FROM"), false); err != nil {
+		return nil, fmt.Errorf("SEARCH_FROM: %w", err)
+	}
+	// a date as the end of the range takes in that whole day
+	if query.to, err = parseSearchTime(viper.GetString("SEARCH_TO"), true); err != nil {
+		return nil, fmt.Errorf("SEARCH_TO: %w", err)
+	}
+	if viper.IsSet("SEARCH_MAX_MATCHES") {
+		if query.maxMatches = viper.GetInt("SEARCH_MAX_MATCHES"); query.maxMatches <= 0 {
+			return nil, fmt.Errorf("SEARCH_MAX_MATCHES must be at least 1, got %d", query.maxMatches)
+		}
+	}
+	roots := searchRoots()
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("SEARCH_PATH is not set and no ARCHIVE_TO_PATH is configured")
+	}
+
+	report := models.NewRunReport("SEARCH")
+	report.OnFile = utils.ObserveFileResult
+	defer report.Finish()
+	for i, root := range roots {
+		if err := ctx.Err(); err != nil {
+			report.JobFailed(i+1, fmt.Errorf("search not started: %w", err))
+			continue
+		}
+		searchArchiveRoot(ctx, i+1, root, query, report)
+	}
+	if query.content != nil && query.matches >= query.maxMatches {
+		log.Warn().Msgf("stopped at %d matching lines, raise SEARCH_MAX_MATCHES or narrow the search", query.maxMatches)
+	}
+	log.Info().Msg("Search completed")
+	return report, nil
+}
+
+// searchRoots are the SEARCH_PATH roots, comma separated, by default the ARCHIVE_TO_PATH of every archive job
+func searchRoots() []string {
+	var roots []string
+	seen := make(map[string]bool)
+	add := func(root string) {
+		root = strings.TrimSpace(root)
+		if root != "" && !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	if searchPath := viper.GetString("SEARCH_PATH"); searchPath != "" {
+		for _, root := range strings.Split(searchPath, ",") {
+			add(root)
+		}
+		return roots
+	}
+	for i := 1; i <= viper.GetInt("ARCHIVE_JOB_COUNT"); i++ {
+		add(viper.GetString("ARCHIVE_TO_PATH" + strconv.Itoa(i)))
+	}
+	return roots
+}
+
+// parseSearchTime reads a date (2006-01-02), a date and time (2006-01-02T15:04) or an age back from now (12h, 7d).
+// With dayEnd a bare date gives the start of the next day.
+func parseSearchTime(value string, dayEnd bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		if dayEnd {
+			date = date.AddDate(0, 0, 1)
+		}
+		return date, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05"} {
+		if date, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return date, nil
+		}
+	}
+	age, err := utils.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a date like 2025-07-06 or an age like 7d, got %q", value)
+	}
+	return time.Now().Add(-age), nil
+}
+
+// matchesName tells whether the original file of the entry is the one searched: a glob on its name or path,
+// or else its name, its path or the end of its path
+func (q *searchQuery) matchesName(sourcePath string) bool {
+	if q.name == "" {
+		return true
+	}
+	name := filepath.Base(sourcePath)
+	if strings.ContainsAny(q.name, "*?[") {
+		nameMatch, _ := filepath.Match(q.name, name)
+		pathMatch, _ := filepath.Match(q.name, sourcePath)
+		return nameMatch || pathMatch
+	}
+	return q.name == name || q.name == sourcePath || strings.HasSuffix(sourcePath, "/"+strings.TrimPrefix(q.name, "/"))
+}
+
+// selects tells whether the archive of the entry is searched, by the name and date of its original file.
+// The date is the one placing the archive in its folder, the modification time for entries without one.
+func (q *searchQuery) selects(entry models.ManifestEntry) bool {
+	date := entry.FileDate
+	if date.IsZero() {
+		date = entry.ModTime
+	}
+	if !q.from.IsZero() && date.Before(q.from) {
+		return false
+	}
+	if !q.to.IsZero() && !date.Before(q.to) {
+		return false
+	}
+	return q.matchesName(entry.SourcePath)
+}
+
+// searchArchiveRoot searches the index of one archive root, building the index first when the root has none
+func searchArchiveRoot(ctx context.Context, jobId int, root string, query *searchQuery, report *models.RunReport) {
+	logger := utils.JobLogger(report, jobId, "")
+	fs, rootPath, err := utils.ResolveStorage(root)
+	if err != nil {
+		logger.Error().Err(err).Msgf("unable to open archive root %s", root)
+		report.JobFailed(jobId, err)
+		return
+	}
+
+	rebuild := viper.GetBool("SEARCH_REBUILD_INDEX")
+	if !rebuild {
+		if exists, _ := afero.Exists(fs, filepath.Join(rootPath, utils.ArchiveIndexFileName)); !exists {
+			logger.Info().Msgf("no archive index in %s yet, building it", root)
+			rebuild = true
+		}
+	}
+	if rebuild {
+		count, err := utils.RebuildArchiveIndex(ctx, fs, rootPath)
+		if err != nil {
+			logger.Error().Err(err).Msgf("unable to build the archive index of %s", root)
+			report.JobFailed(jobId, err)
+			return
+		}
+		logger.Info().Msgf("indexed %d archives in %s", count, root)
+	}
+
+	var hits []models.ManifestEntry
+	scanned := 0
+	err = utils.ReadArchiveIndex(ctx, fs, rootPath, func(entry models.ManifestEntry) bool {
+		scanned++
+		if query.selects(entry) {
+			hits = append(hits, entry)
+		}
+		return true
+	})
+	if err != nil {
+		logger.Error().Err(err).Msgf("unable to read the archive index of %s", root)
+		report.JobFailed(jobId, err)
+		return
+	}
+	report.AddMatched(jobId, scanned)
+	logger.Info().Msgf("%d of %d archives in %s match", len(hits), scanned, root)
+
+	for _, entry := range hits {
+		start := time.Now()
+		path := filepath.Join(rootPath, entry.Folder, entry.Archive)
+		location := utils.DescribeLocation(fs, path)
+		if query.content == nil {
+			fmt.Fprintf(searchOutput, "%s\t%s\tmodified %s\tarchived %s\n", entry.SourcePath, location,
+				entry.ModTime.Format(time.RFC3339), entry.ArchivedAt.Format(time.RFC3339))
+			report.AddFile(jobId, location, models.FileStatusFound, nil, 0, 0, start)
+			continue
+		}
+		if query.matches >= query.maxMatches {
+			break
+		}
+		found, err := grepArchive(ctx, fs, path, entry, query)
+		if err != nil {
+			logger.Error().Err(err).Msgf("unable to search %s", location)
+			report.AddFailure(jobId, location, "search", err, 0, 0, start)
+			continue
+		}
+		if found > 0 {
+			logger.Info().Msgf("%d matching lines in %s", found, location)
+			report.AddFile(jobId, location, models.FileStatusFound, nil, 0, 0, start)
+		}
+	}
+}
+
+// grepArchive decompresses the entries of the archive as a stream and prints the lines matching the query
+// as <archive>:<source file>:<line number>:<line>
+func grepArchive(ctx context.Context, fs afero.Fs, path string, entry models.ManifestEntry, query *searchQuery) (int, error) {
+	location := utils.DescribeLocation(fs, path)
+	file, err := fs.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var archive io.ReaderAt = file
+	var size int64
+	if strings.HasSuffix(path, utils.EncryptedFileExtension) {
+		content, err := decryptArchive(location, utils.NewContextReader(ctx, file))
+		if err != nil {
+			return 0, err
+		}
+		// zip needs random access, the decrypted archive is spooled to a temporary file
+		spool, err := os.CreateTemp("", "cse-search-*.zip")
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if size, err = io.Copy(spool, content); err != nil {
+			return 0, fmt.Errorf("failed to decrypt %s: %w", location, err)
+		}
+		archive = spool
+	} else {
+		info, err := file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		size = info.Size()
+	}
+
+	reader, err := zip.NewReader(archive, size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open zip %s: %w", location, err)
+	}
+	found := 0
+	for _, zipEntry := range reader.File {
+		if zipEntry.FileInfo().IsDir() {
+			continue
+		}
+		content, err := zipEntry.Open()
+		if err != nil {
+			return found, fmt.Errorf("failed to open %s in %s: %w", zipEntry.Name, location, err)
+		}
+		lines := bufio.NewReader(utils.NewContextReader(ctx, content))
+		for number := 1; query.matches < query.maxMatches; number++ {
+			line, err := lines.ReadString('\n')
+			if line != "" && query.content.MatchString(line) {
+				fmt.Fprintf(searchOutput, "%s:%s:%d:%s\n", location, entry.SourcePath, number, strings.TrimRight(line, "\r\n"))
+				found++
+				query.matches++
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				content.Close()
+				return found, fmt.Errorf("failed to read %s in %s: %w", zipEntry.Name, location, err)
+			}
+		}
+		content.Close()
+	}
+	return found, nil
+}
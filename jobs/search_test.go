@@ -0,0 +1,160 @@
+package jobs
+
+import (
+	"CSEFileManager/models"
+	"CSEFileManager/utils"
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+func TestParseSearchTime(t *testing.T) {
+	day := time.Date(2025, 7, 6, 0, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		value  string
+		dayEnd bool
+		want   time.Time
+	}{
+		{"", false, time.Time{}},
+		{" ", true, time.Time{}},
+		{"2025-07-06", false, day},
+		{"2025-07-06", true, day.AddDate(0, 0, 1)},
+		{"2025-07-06T10:30", true, day.Add(10*time.Hour + 30*time.Minute)},
+		{"2025-07-06T10:30:15", false, day.Add(10*time.Hour + 30*time.Minute + 15*time.Second)},
+	} {
+		got, err := parseSearchTime(test.value, test.dayEnd)
+		if err != nil || !got.Equal(test.want) {
+			t.Errorf("parseSearchTime(%q, %t) = %s, %v, want %s", test.value, test.dayEnd, got, err, test.want)
+		}
+	}
+
+	got, err := parseSearchTime("7d", false)
+	if want := time.Now().AddDate(0, 0, -7); err != nil || got.Sub(want).Abs() > time.Minute {
+		t.Errorf("parseSearchTime(7d) = %s, %v, want about %s", got, err, want)
+	}
+	for _, value := range []string{"yesterday", "2025-13-01", "07/06/2025"} {
+		if _, err := parseSearchTime(value, false); err == nil {
+			t.Errorf("parseSearchTime(%q) accepted", value)
+		}
+	}
+}
+
+func TestMatchesName(t *testing.T) {
+	const source = "/var/log/app/server.log"
+	for _, test := range []struct {
+		name string
+		want bool
+	}{
+		{"", true},
+		{"server.log", true},
+		{source, true},
+		{"app/server.log", true},
+		{"/app/server.log", true},
+		{"server*.log", true},
+		{"/var/log/*/server.log", true},
+		{"pp/server.log", false},
+		{"server.log.1", false},
+		{"*.txt", false},
+		{"other.log", false},
+	} {
+		query := &searchQuery{name: test.name}
+		if got := query.matchesName(source); got != test.want {
+			t.Errorf("matchesName(%q) = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+// writeSearchArchive zips the log lines into the folder of the archive root and records them in its manifest
+func writeSearchArchive(t *testing.T, fs afero.Fs, folder, sourcePath, lines string, fileDate time.Time) {
+	t.Helper()
+	archive := filepath.Base(sourcePath) + ".zip"
+	var content bytes.Buffer
+	zipWriter := zip.NewWriter(&content)
+	entry, err := zipWriter.CreateHeader(&zip.FileHeader{Name: filepath.Base(sourcePath), Comment: sourcePath, Method: zip.Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := entry.Write([]byte(lines)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, filepath.Join("/archives", folder, archive), content.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = utils.AppendManifest(fs, filepath.Join("/archives", folder), models.ManifestEntry{
+		SourcePath: sourcePath, FileDate: fileDate, ModTime: fileDate, Archive: archive, Folder: folder,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runSearch(t *testing.T, settings map[string]any, name, content string) (*models.RunReport, string) {
+	t.Helper()
+	for key, value := range settings {
+		viper.Set(key, value)
+	}
+	var output bytes.Buffer
+	previous := searchOutput
+	searchOutput = &output
+	t.Cleanup(func() {
+		searchOutput = previous
+		for key := range settings {
+			viper.Set(key, nil)
+		}
+	})
+	report, err := RunSearch(context.Background(), models.Args{Arg1: name, Arg2: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report, output.String()
+}
+
+func TestRunSearchPrintsHits(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	previous := utils.LocalFs
+	utils.LocalFs = fs
+	t.Cleanup(func() { utils.LocalFs = previous })
+	march5 := time.Date(2024, 3, 5, 0, 0, 0, 0, time.Local)
+	writeSearchArchive(t, fs, "2024/03/05", "/var/log/app.log", "started\nERROR disk full\nretrying\nERROR again\n", march5)
+	writeSearchArchive(t, fs, "2024/03/06", "/var/log/app.log", "ERROR next day\n", march5.AddDate(0, 0, 1))
+	writeSearchArchive(t, fs, "2024/03/06", "/var/log/db.log", "ERROR in the db\n", march5.AddDate(0, 0, 1))
+
+	// the index is built on the first search, hits go to the output only
+	settings := map[string]any{"SEARCH_PATH": "/archives"}
+	report, output := runSearch(t, settings, "app.log", "")
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "/var/log/app.log\t/archives/2024/03/05/app.log.zip\t") {
+		t.Fatalf("listed %q", output)
+	}
+	if report.Counts[models.FileStatusFound] != 2 {
+		t.Fatalf("counts %v, want 2 found", report.Counts)
+	}
+	if exists, _ := afero.Exists(fs, filepath.Join("/archives", utils.ArchiveIndexFileName)); !exists {
+		t.Fatal("archive index not built")
+	}
+
+	settings["SEARCH_TO"] = "2024-03-05"
+	_, output = runSearch(t, settings, "", "ERROR")
+	want := "/archives/2024/03/05/app.log.zip:/var/log/app.log:2:ERROR disk full\n" +
+		"/archives/2024/03/05/app.log.zip:/var/log/app.log:4:ERROR again\n"
+	if output != want {
+		t.Fatalf("grep printed %q, want %q", output, want)
+	}
+
+	settings["SEARCH_TO"] = ""
+	settings["SEARCH_MAX_MATCHES"] = 3
+	_, output = runSearch(t, settings, "", "ERROR")
+	if lines := strings.Split(strings.TrimSpace(output), "\n"); len(lines) != 3 {
+		t.Fatalf("grep printed %d lines past SEARCH_MAX_MATCHES: %q", len(lines), output)
+	}
+}
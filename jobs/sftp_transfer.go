@@ -0,0 +1,128 @@
+package jobs
+
+import (
+	"CSEFileManager/models"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/rs/zerolog"
+	"github.com/spf13/afero"
+	"github.com/spf13/afero/sftpfs"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	TransferTypeSftpGet = "SFTP_GET"
+	TransferTypeSftpPut = "SFTP_PUT"
+
+	defaultSftpPort    = 22
+	sftpConnectTimeout = 30 * time.Second
+)
+
+// sftpSession keeps the ssh connection and the sftp client opened for a job,
+// the remote side is used through fs like any other storage
+type sftpSession struct {
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+	fs         afero.Fs
+	logger     zerolog.Logger
+}
+
+func isSftpTransfer(transferType string) bool {
+	return transferType == TransferTypeSftpGet || transferType == TransferTypeSftpPut
+}
+
+func newSftpSession(cfg models.SftpConfig, logger zerolog.Logger) (*sftpSession, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("sftp host is not configured")
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = defaultSftpPort
+	}
+
+	authMethods, err := sftpAuthMethods(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	knownHostsPath := cfg.KnownHostsPath
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve home directory for known_hosts: %w", err)
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts file %s: %w", knownHostsPath, err)
+	}
+
+	address := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	logger.Info().Msgf("Connecting to sftp server %s as %s", address, cfg.User)
+	sshClient, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sftpConnectTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to sftp server %s: %w", address, err)
+	}
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to start sftp subsystem on %s: %w", address, err)
+	}
+	logger.Info().Msgf("Connected to sftp server %s", address)
+
+	return &sftpSession{sshClient: sshClient, sftpClient: sftpClient, fs: sftpfs.New(sftpClient), logger: logger}, nil
+}
+
+// sftpAuthMethods prefers the private key and falls back to the password when both are set
+func sftpAuthMethods(cfg models.SftpConfig) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if cfg.KeyPath != "" {
+		keyBytes, err := os.ReadFile(cfg.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sftp private key %s: %w", cfg.KeyPath, err)
+		}
+		var signer ssh.Signer
+		if cfg.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(cfg.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(keyBytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sftp private key %s: %w", cfg.KeyPath, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if cfg.Password != "" {
+		methods = append(methods, ssh.Password(cfg.Password))
+	}
+
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no sftp credentials configured, set a key path or a password")
+	}
+	return methods, nil
+}
+
+func (s *sftpSession) Close() {
+	if err := s.sftpClient.Close(); err != nil {
+		s.logger.Warn().Err(err).Msg("Failed to close sftp client")
+	}
+	if err := s.sshClient.Close(); err != nil {
+		s.logger.Warn().Err(err).Msg("Failed to close ssh connection")
+	}
+}
@@ -0,0 +1,263 @@
+package jobs
+
+import (
+	"CSEFileManager/models"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/rs/zerolog"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sftpTestUser     = "cse"
+	sftpTestPassword = "s3cret-pass"
+)
+
+// sftpTestServer is an ssh server running the sftp subsystem over the local disk, for the lifetime of a test
+type sftpTestServer struct {
+	host    string
+	port    int
+	hostKey ssh.PublicKey
+}
+
+// startSftpServer accepts the test user with its password or with the given authorized key
+func startSftpServer(t *testing.T, authorizedKey ssh.PublicKey) *sftpTestServer {
+	t.Helper()
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == sftpTestUser && string(password) == sftpTestPassword {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if authorizedKey != nil && conn.User() == sftpTestUser && bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		listener.Close()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serveSftpConn(conn, config)
+			}()
+		}
+	}()
+
+	address := listener.Addr().(*net.TCPAddr)
+	return &sftpTestServer{host: address.IP.String(), port: address.Port, hostKey: hostSigner.PublicKey()}
+}
+
+func serveSftpConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for request := range channelRequests {
+				// the payload is the length prefixed subsystem name
+				request.Reply(request.Type == "subsystem" && string(request.Payload[4:]) == "sftp", nil)
+			}
+		}()
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			channel.Close()
+			continue
+		}
+		go func() {
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+// knownHosts writes a known_hosts file holding the key for the server address
+func (s *sftpTestServer) knownHosts(t *testing.T, key ssh.PublicKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(s.host, strconv.Itoa(s.port)))}, key)
+	if err := os.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func (s *sftpTestServer) config(knownHostsPath string) models.SftpConfig {
+	return models.SftpConfig{Host: s.host, Port: s.port, User: sftpTestUser, KnownHostsPath: knownHostsPath}
+}
+
+// clientKey writes a new private key, encrypted when a passphrase is given, and returns its path and public key
+func clientKey(t *testing.T, passphrase string) (string, ssh.PublicKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block *pem.Block
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(private, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(private, "")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, sshPublic
+}
+
+// assertSftpPut copies a file to the server over the session like an SFTP_PUT job, verifying it
+func assertSftpPut(t *testing.T, session *sftpSession) {
+	t.Helper()
+	remote := filepath.Join(t.TempDir(), "out", "data.csv")
+	if _, err := copyFile(context.Background(), newSourceFs(t), "/in/data.csv", session.fs, remote, true, nil, zerolog.Nop()); err != nil {
+		t.Fatalf("sftp put: %v", err)
+	}
+	content, err := os.ReadFile(remote)
+	if err != nil || string(content) != transferContent {
+		t.Fatalf("remote file holds %q, %v", content, err)
+	}
+	if got, err := afero.ReadFile(session.fs, remote); err != nil || string(got) != transferContent {
+		t.Fatalf("sftp get gave %q, %v", got, err)
+	}
+}
+
+func TestSftpSessionKeyAuth(t *testing.T) {
+	for _, passphrase := range []string{"", "key-passphrase"} {
+		t.Run(fmt.Sprintf("passphrase=%t", passphrase != ""), func(t *testing.T) {
+			keyPath, publicKey := clientKey(t, passphrase)
+			server := startSftpServer(t, publicKey)
+			cfg := server.config(server.knownHosts(t, server.hostKey))
+			cfg.KeyPath, cfg.KeyPassphrase = keyPath, passphrase
+
+			session, err := newSftpSession(cfg, zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			assertSftpPut(t, session)
+		})
+	}
+}
+
+func TestSftpSessionKeyAuthRejectsUnknownKey(t *testing.T) {
+	keyPath, _ := clientKey(t, "")
+	_, authorized := clientKey(t, "")
+	server := startSftpServer(t, authorized)
+	cfg := server.config(server.knownHosts(t, server.hostKey))
+	cfg.KeyPath = keyPath
+
+	if session, err := newSftpSession(cfg, zerolog.Nop()); err == nil {
+		session.Close()
+		t.Fatal("connected with a key the server does not know")
+	}
+}
+
+func TestSftpSessionPasswordAuth(t *testing.T) {
+	server := startSftpServer(t, nil)
+	cfg := server.config(server.knownHosts(t, server.hostKey))
+
+	cfg.Password = "wrong"
+	if session, err := newSftpSession(cfg, zerolog.Nop()); err == nil {
+		session.Close()
+		t.Fatal("connected with a wrong password")
+	}
+
+	cfg.Password = sftpTestPassword
+	session, err := newSftpSession(cfg, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	assertSftpPut(t, session)
+}
+
+func TestSftpSessionRejectsUnknownHostKey(t *testing.T) {
+	server := startSftpServer(t, nil)
+	_, otherKey := clientKey(t, "")
+	emptyKnownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(emptyKnownHosts, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, knownHostsPath := range map[string]string{
+		"key mismatch":   server.knownHosts(t, otherKey),
+		"host not known": emptyKnownHosts,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := server.config(knownHostsPath)
+			cfg.Password = sftpTestPassword
+
+			session, err := newSftpSession(cfg, zerolog.Nop())
+			if err == nil {
+				session.Close()
+				t.Fatal("connected to a server whose host key is not in known_hosts")
+			}
+			var keyErr *knownhosts.KeyError
+			if !errors.As(err, &keyErr) {
+				t.Fatalf("got %v, want a known_hosts rejection", err)
+			}
+		})
+	}
+}
@@ -3,13 +3,20 @@ package main
 import (
 	"CSEFileManager/jobs"
 	"CSEFileManager/models"
+	"CSEFileManager/utils"
+	"context"
 	"flag"
+	"fmt"
 	"github.com/natefinch/lumberjack"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/rs/zerolog/pkgerrors"
 	"github.com/spf13/viper"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 // Flags declared globally, so they can be used in both init() and main()
@@ -18,6 +25,11 @@ var (
 	configPath = flag.String("config-path", ".", "Path to the config file directory")
 	jobType    = flag.String("job-type", "ARCHIVE", "Type of job to execute")
 	Arg1       = flag.String("arg1", "", "Argument 1 (optional)")
+	Arg2       = flag.String("arg2", "", "Argument 2 (optional)")
+	daemon     = flag.Bool("daemon", false, "Keep running and repeat the job every -interval")
+	interval   = flag.Duration("interval", 5*time.Minute, "Time between runs in daemon mode")
+	watch      = flag.Bool("watch", false, "Keep running and transfer FUPM files as soon as they land")
+	verbose    = flag.Bool("verbose", false, "Log at debug level at least, whatever LOG_LEVEL says")
 )
 
 func main() {
@@ -26,15 +38,173 @@ func main() {
 		ConfigPath: *configPath,
 		JobType:    *jobType,
 		Arg1:       *Arg1,
+		Arg2:       *Arg2,
 	}
 
+	// SIGINT/SIGTERM stop archive and FUPM runs between files, the files in progress are finished within their
+	// file timeout; restores and searches stop right away. Once stop() restored the default handling,
+	// a second signal kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		log.Warn().Msg("signal received, stopping after the files in progress, signal again to stop now")
+		stop()
+	}()
+
+	if *watch {
+		os.Exit(runWatch(ctx, appFlags))
+	}
+	if *daemon {
+		runDaemon(ctx, appFlags)
+		return
+	}
+	os.Exit(runJob(ctx, appFlags))
+}
+
+// runJob runs the selected job once and returns the exit code for it
+func runJob(ctx context.Context, appFlags models.Args) int {
+	var report *models.RunReport
+	var err error
 	if *jobType == "" || *jobType == "ARCHIVE" {
 		log.Info().Msg("starting job..")
-		jobs.RunArchiver()
+		report, err = jobs.RunArchiver(ctx)
 	} else if *jobType == "FUPM" {
-		jobs.RunFupmJobs(appFlags)
+		report, err = jobs.RunFupmJobs(ctx, appFlags)
+	} else if *jobType == "RESTORE" {
+		report, err = jobs.RunRestore(ctx, appFlags)
+	} else if *jobType == "SEARCH" {
+		report, err = jobs.RunSearch(ctx, appFlags)
+	} else {
+		err = fmt.Errorf("unknown job type %s", *jobType)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("invalid configuration, exiting with code %d", models.ExitConfigError)
+		return models.ExitConfigError
+	}
+	return finishRun(report)
+}
+
+// finishRun logs, writes and exports the report of a run and returns the exit code for it
+func finishRun(report *models.RunReport) int {
+	utils.LogRunSummary(report)
+	if reportPath := viper.GetString("REPORT_PATH"); reportPath != "" {
+		if err := utils.WriteRunReport(report, reportPath); err != nil {
+			log.Error().Err(err).Msg("unable to write run report")
+		} else {
+			log.Info().Msgf("run report written to %s", reportPath)
+		}
+	}
+
+	utils.ObserveRunReport(report)
+	// a daemon or a watcher serves its metrics, one-shot runs leave them for the node_exporter textfile collector
+	if textfilePath := viper.GetString("METRICS_TEXTFILE_PATH"); textfilePath != "" && !*daemon && !*watch {
+		if err := utils.WriteMetricsTextfile(textfilePath); err != nil {
+			log.Error().Err(err).Msg("unable to write metrics textfile")
+		}
+	}
+
+	exitCode := report.ExitCode()
+	switch exitCode {
+	case models.ExitSuccess:
+		log.Info().Msg("Job executed successfully")
+	case models.ExitNothingToDo:
+		log.Warn().Msgf("Job found nothing to do, exiting with code %d", exitCode)
+	default:
+		log.Warn().Msgf("Job finished with %d failures, exiting with code %d", report.Failed(), exitCode)
+	}
+	return exitCode
+}
+
+// runDaemon repeats the job every -interval and serves the metrics endpoint until ctx is cancelled.
+// Changes of the config file, or SIGHUP, are applied between runs once the new job definitions are valid.
+func runDaemon(ctx context.Context, appFlags models.Args) {
+	var metricsServer *http.Server
+	if metricsAddr := viper.GetString("METRICS_LISTEN_ADDR"); metricsAddr != "" {
+		metricsServer = utils.ServeMetrics(metricsAddr)
+	}
+	var reloads <-chan string
+	configWatcher, err := utils.WatchConfig(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("config changes will not be picked up until restart")
+	} else {
+		reloads = configWatcher.Changes()
+	}
+
+	log.Info().Msgf("running %s as daemon every %s", *jobType, *interval)
+	for ctx.Err() == nil {
+		exitCode := runJob(ctx, appFlags)
+		if ctx.Err() != nil {
+			log.Warn().Msgf("run stopped with code %d", exitCode)
+			break
+		}
+		log.Info().Msgf("run finished with code %d, next run in %s", exitCode, *interval)
+		next := time.NewTimer(*interval)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				break wait
+			case <-next.C:
+				break wait
+			case reason := <-reloads:
+				reloadConfig(configWatcher, reason)
+			}
+		}
+		next.Stop()
+	}
+
+	stopMetricsServer(metricsServer)
+	log.Info().Msg("daemon stopped")
+}
+
+// runWatch transfers FUPM files as they land and serves the metrics endpoint until ctx is cancelled,
+// every batch of files is summarised and reported like a run of its own
+func runWatch(ctx context.Context, appFlags models.Args) int {
+	if *jobType != "FUPM" {
+		log.Error().Msgf("-watch only applies to FUPM jobs, not %s, exiting with code %d", *jobType, models.ExitConfigError)
+		return models.ExitConfigError
+	}
+	var metricsServer *http.Server
+	if metricsAddr := viper.GetString("METRICS_LISTEN_ADDR"); metricsAddr != "" {
+		metricsServer = utils.ServeMetrics(metricsAddr)
+	}
+	defer stopMetricsServer(metricsServer)
+
+	err := jobs.WatchFupmJobs(ctx, appFlags, func(report *models.RunReport) {
+		log.Info().Msgf("batch finished with code %d", finishRun(report))
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("invalid configuration, exiting with code %d", models.ExitConfigError)
+		return models.ExitConfigError
+	}
+	return models.ExitSuccess
+}
+
+// stopMetricsServer shuts the metrics endpoint down, if one is served
+func stopMetricsServer(metricsServer *http.Server) {
+	if metricsServer == nil {
+		return
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	metricsServer.Shutdown(shutdownCtx)
+}
+
+// reloadConfig applies the config file when the job definitions it holds are valid, the running ones stay otherwise
+func reloadConfig(configWatcher *utils.ConfigWatcher, reason string) {
+	log.Info().Msgf("reloading settings: %s", reason)
+	applied, err := configWatcher.Reload(func() error { return jobs.ValidateConfig(*jobType) })
+	if err != nil {
+		log.Error().Err(err).Msg("config reload failed")
+		return
+	}
+	if !applied {
+		log.Info().Msg("config file unchanged, nothing to reload")
+		return
+	}
+	if err := configureLogger(); err != nil {
+		log.Error().Err(err).Msg("unable to apply the logger settings")
 	}
-	log.Info().Msg("Job executed successfully")
 }
 
 func init() {
@@ -59,12 +229,28 @@ func init() {
 	err := viper.ReadInConfig()
 	if err != nil {
 		log.Error().Err(err).Msg("unable to read config file, program will exit now")
-		os.Exit(1)
+		os.Exit(models.ExitConfigError)
 	}
 
-	//log
+	utils.SetVerboseLogging(*verbose)
+	if err := configureLogger(); err != nil {
+		log.Error().Err(err).Msg("invalid logger settings, program will exit now")
+		os.Exit(models.ExitConfigError)
+	}
+}
+
+// logFile is the rotating log file, replaced when the settings are reloaded
+var logFile *lumberjack.Logger
+
+// configureLogger sets up the console and file logger from the LOG_* settings, every line carrying the job type
+func configureLogger() error {
 	log.Info().Msg("initializing logger...")
-	logFile := &lumberjack.Logger{
+	level, err := utils.LogLevel()
+	if err != nil {
+		return err
+	}
+	previous := logFile
+	logFile = &lumberjack.Logger{
 		Filename:   viper.GetString("LOG_PATH"),
 		MaxSize:    viper.GetInt("LOG_MAX_SIZE"),   // MB
 		MaxBackups: viper.GetInt("LOG_MAX_BACKUP"), // Number of backups to keep
@@ -74,5 +260,11 @@ func init() {
 	zerolog.TimeFieldFormat = viper.GetString("LOG_DATETIME_PATTERN")
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 	multi := zerolog.MultiLevelWriter(os.Stdout, logFile)
-	log.Logger = zerolog.New(multi).With().Timestamp().Logger()
+	log.Logger = zerolog.New(utils.NewRedactingWriter(multi)).Level(level).With().Timestamp().Str("job_type", *jobType).Logger()
+	if previous != nil {
+		previous.Close()
+	}
+	// secrets are known before any job logs, settings and connection errors included
+	utils.RedactSecretSettings()
+	return nil
 }
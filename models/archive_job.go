@@ -1,12 +1,51 @@
 package models
 
+import "time"
+
+// What happens to the original file once archived
+const (
+	OriginalFileKeep   = "keep"
+	OriginalFileDelete = "delete"
+	// copytruncate: the live file is emptied in place, for writers that never reopen it
+	OriginalFileTruncate = "truncate"
+)
+
+// Where the date placing an archive in its folder comes from
+const (
+	DateSourceModTime  = "mtime"
+	DateSourceFileName = "name" // also drives the age rules, falls back to the mtime when the name holds no date
+	DateSourceRun      = "run"
+)
+
+// What happens when the archive name is already taken in the backup folder
+const (
+	OnCollisionVersion   = "version"   // <file>.1.zip, <file>.2.zip...
+	OnCollisionTimestamp = "timestamp" // <file>.<mtime 20060102-150405>.zip
+	OnCollisionPrefix    = "prefix"    // <source dir>_<file>.zip
+	OnCollisionFail      = "fail"
+	OnCollisionOverwrite = "overwrite"
+)
+
 type ArchiveJob struct {
-	JobId                int    `json:"job_id"`
-	ArchiveFromPath      string `json:"archive_from_path"`
-	ArchiveToPath        string `json:"archive_to_archive"`
-	FilePattern          string `json:"file_pattern"`
-	FilePatternSeparator string `json:"file_pattern_separator"`
-	ArchiveIfOlderThan   int    `json:"archive_if_older_than"`
-	DeleteOriginalFile   bool   `json:"delete_original_file"`
-	Processed            bool   `json:"processed"`
+	JobId                int           `json:"job_id"`
+	ArchiveFromPath      string        `json:"archive_from_path"`
+	ArchiveToPath        string        `json:"archive_to_archive"`
+	FilePattern          string        `json:"file_pattern"`
+	FilePatternSeparator string        `json:"file_pattern_separator"`
+	ArchiveIfOlderThan   time.Duration `json:"archive_if_older_than"`  // 0 archives regardless of age
+	ArchiveIfLargerThan  int64         `json:"archive_if_larger_than"` // bytes, 0 disables the size rule
+	KeepUnarchived       int           `json:"keep_unarchived"`        // newest files allowed to stay, 0 disables the rule
+	OriginalFile         string        `json:"original_file"`          // keep, delete or truncate once archived
+	IncludeOpenFiles     bool          `json:"include_open_files"`     // archive files other processes still hold open
+	FolderLayout         string        `json:"folder_layout"`          // backup folder template below ArchiveToPath
+	DateSource           string        `json:"date_source"`            // mtime, name or run
+	NameDateFormat       string        `json:"name_date_format"`       // tokens of the date in the file name, e.g. YYYYMMDDhhmmss
+	NameDateRegex        string        `json:"name_date_regex"`        // its first group holds the date, empty searches the format
+	OnCollision          string        `json:"on_collision"`           // version, timestamp, prefix, fail or overwrite
+	EncryptRecipients    string        `json:"encrypt_recipients"`
+	NotifyTemplate       string        `json:"notify_template"`
+	LogLevel             string        `json:"log_level"` // replaces LOG_LEVEL for the lines of this job, empty keeps it
+	JobTimeout           time.Duration `json:"job_timeout"`
+	FileTimeout          time.Duration `json:"file_timeout"`
+	Processed            bool          `json:"processed"`
 }
@@ -0,0 +1,17 @@
+package models
+
+// Process exit codes, cron and the scheduler branch on these.
+// They start at 10, clear of the 1 of log.Fatal and the 2 of a Go panic, so a crash never reads as an outcome.
+const (
+	ExitSuccess = 0
+	// settings could not be read or a job definition is invalid, nothing was attempted
+	ExitConfigError = 10
+	// some files or jobs failed, others went through
+	ExitPartialFailure = 11
+	// everything that was attempted failed
+	ExitTotalFailure = 12
+	// no failures, but nothing was archived or transferred, or a job found none of its files
+	ExitNothingToDo = 13
+	// no failures, but another process held the lock of at least one job, so that job was skipped
+	ExitLocked = 14
+)
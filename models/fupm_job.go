@@ -1,11 +1,22 @@
 package models
 
+import "time"
+
 type FupmJob struct {
-	JobId                int    `json:"job_id"`
-	FilePattern          string `json:"file_pattern"`
-	FileTransferType     string `json:"file_transfer_type"`
-	FileTransferFromPath string `json:"file_transfer_from_path"`
-	FileTransferToPath   string `json:"file_transfer_to_path"`
-	FileUploadSqlScript  string `json:"file_upload_sql_script"`
-	ProcessOnce          bool   `json:"process_once"`
+	JobId                int           `json:"job_id"`
+	FilePattern          string        `json:"file_pattern"`
+	FileTransferType     string        `json:"file_transfer_type"`
+	FileTransferFromPath string        `json:"file_transfer_from_path"`
+	FileTransferToPath   string        `json:"file_transfer_to_path"`
+	FileUploadSqlScript  string        `json:"file_upload_sql_script"`
+	ProcessOnce          bool          `json:"process_once"`
+	KeepOrder            bool          `json:"keep_order"`
+	VerifyChecksum       bool          `json:"verify_checksum"`
+	WriteChecksumFile    bool          `json:"write_checksum_file"`
+	EncryptRecipients    string        `json:"encrypt_recipients"`
+	NotifyTemplate       string        `json:"notify_template"`
+	LogLevel             string        `json:"log_level"` // replaces LOG_LEVEL for the lines of this job, empty keeps it
+	JobTimeout           time.Duration `json:"job_timeout"`
+	FileTimeout          time.Duration `json:"file_timeout"`
+	Sftp                 SftpConfig    `json:"sftp"`
 }
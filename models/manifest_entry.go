@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// What happened to the original file, as recorded in the manifest
+const (
+	ManifestOriginalKept      = "kept"
+	ManifestOriginalDeleted   = "deleted"
+	ManifestOriginalTruncated = "truncated"
+)
+
+// ManifestEntry is one line of the manifest.jsonl of a backup folder, written for every archive.
+// The archive index at the root of the archives holds the same lines for every folder.
+type ManifestEntry struct {
+	SourcePath  string    `json:"source_path"` // absolute path or s3 uri of the original file
+	Size        int64     `json:"size"`        // bytes archived
+	ModTime     time.Time `json:"mtime"`
+	FileDate    time.Time `json:"file_date"` // date placing the archive in its folder, per the job date source
+	SHA256      string    `json:"sha256"`    // of the archived content, before compression
+	Archive     string    `json:"archive"`
+	Folder      string    `json:"folder"` // backup folder of the archive, relative to the archive root
+	ArchiveSize int64     `json:"archive_size"`
+	Encrypted   bool      `json:"encrypted"`
+	JobId       int       `json:"job_id"`
+	Host        string    `json:"host"`
+	ArchivedAt  time.Time `json:"archived_at"`
+	Original    string    `json:"original"` // kept, deleted or truncated
+}
@@ -0,0 +1,188 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	FileStatusArchived         = "archived"
+	FileStatusTransferred      = "transferred"
+	FileStatusRestored         = "restored"
+	FileStatusFound            = "found"
+	FileStatusSkippedAge       = "skipped_age"
+	FileStatusSkippedDirectory = "skipped_directory"
+	FileStatusSkippedProcessed = "skipped_processed"
+	FileStatusSkippedOpen      = "skipped_open"
+	FileStatusSkippedEmpty     = "skipped_empty"
+	FileStatusFailed           = "failed"
+)
+
+type FileResult struct {
+	File     string        `json:"file"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Reason   string        `json:"reason,omitempty"`
+	BytesIn  int64         `json:"bytes_in"`
+	BytesOut int64         `json:"bytes_out"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+type JobReport struct {
+	JobId        int          `json:"job_id"`
+	FilesMatched int          `json:"files_matched"`
+	Error        string       `json:"error,omitempty"`
+	LockedBy     string       `json:"locked_by,omitempty"`
+	Files        []FileResult `json:"files"`
+}
+
+// RunReport collects per job, per file outcomes of one run, it is safe for concurrent use
+type RunReport struct {
+	JobType   string         `json:"job_type"`
+	RunId     string         `json:"run_id"` // tags the log lines of the run
+	StartTime time.Time      `json:"start_time"`
+	EndTime   time.Time      `json:"end_time"`
+	Duration  time.Duration  `json:"duration_ns"`
+	Counts    map[string]int `json:"counts"`
+	Jobs      []*JobReport   `json:"jobs"`
+
+	// OnFile is called for every recorded file, outside the lock
+	OnFile func(jobType string, jobId int, result FileResult) `json:"-"`
+
+	mu sync.Mutex
+}
+
+func NewRunReport(jobType string) *RunReport {
+	return &RunReport{JobType: jobType, RunId: newRunId(), StartTime: time.Now(), Counts: make(map[string]int)}
+}
+
+// newRunId is a random 16 hex digit id, unique enough to tell runs apart in the logs
+func newRunId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// job returns the report of the given job, creating it on first use, callers hold the lock
+func (r *RunReport) job(jobId int) *JobReport {
+	for _, job := range r.Jobs {
+		if job.JobId == jobId {
+			return job
+		}
+	}
+	job := &JobReport{JobId: jobId}
+	r.Jobs = append(r.Jobs, job)
+	return job
+}
+
+func (r *RunReport) AddMatched(jobId int, count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.job(jobId).FilesMatched += count
+}
+
+// JobFailed records an error that stopped the whole job
+func (r *RunReport) JobFailed(jobId int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.job(jobId).Error = err.Error()
+}
+
+// JobLocked records a job skipped because another process holds its lock
+func (r *RunReport) JobLocked(jobId int, holder string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.job(jobId).LockedBy = holder
+}
+
+// AddFile records the outcome of one file, the duration is measured from start
+func (r *RunReport) AddFile(jobId int, file, status string, err error, bytesIn, bytesOut int64, start time.Time) {
+	result := FileResult{
+		File:     file,
+		Status:   status,
+		BytesIn:  bytesIn,
+		BytesOut: bytesOut,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	r.add(jobId, result)
+}
+
+// AddFailure records a failed file along with the step that failed (stat, archive, transfer, db_insert...)
+func (r *RunReport) AddFailure(jobId int, file, reason string, err error, bytesIn, bytesOut int64, start time.Time) {
+	result := FileResult{
+		File:     file,
+		Status:   FileStatusFailed,
+		Error:    err.Error(),
+		Reason:   reason,
+		BytesIn:  bytesIn,
+		BytesOut: bytesOut,
+		Duration: time.Since(start),
+	}
+	r.add(jobId, result)
+}
+
+func (r *RunReport) add(jobId int, result FileResult) {
+	r.mu.Lock()
+	job := r.job(jobId)
+	job.Files = append(job.Files, result)
+	r.Counts[result.Status]++
+	r.mu.Unlock()
+
+	if r.OnFile != nil {
+		r.OnFile(r.JobType, jobId, result)
+	}
+}
+
+func (r *RunReport) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.EndTime = time.Now()
+	r.Duration = r.EndTime.Sub(r.StartTime)
+}
+
+// Failed counts failed files and failed jobs
+func (r *RunReport) Failed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failed := r.Counts[FileStatusFailed]
+	for _, job := range r.Jobs {
+		if job.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// ExitCode maps the outcome of the run to one of the process exit codes
+func (r *RunReport) ExitCode() int {
+	failed := r.Failed()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	succeeded := r.Counts[FileStatusArchived] + r.Counts[FileStatusTransferred] + r.Counts[FileStatusRestored] + r.Counts[FileStatusFound]
+	switch {
+	case failed > 0 && succeeded == 0:
+		return ExitTotalFailure
+	case failed > 0:
+		return ExitPartialFailure
+	}
+	for _, job := range r.Jobs {
+		if job.LockedBy != "" {
+			return ExitLocked
+		}
+	}
+	if succeeded == 0 {
+		return ExitNothingToDo
+	}
+	for _, job := range r.Jobs {
+		if job.FilesMatched == 0 {
+			return ExitNothingToDo
+		}
+	}
+	return ExitSuccess
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunReportExitCode(t *testing.T) {
+	// each step records the outcome of a job, jobs being numbered in order
+	transferred := func(r *RunReport, jobId int) {
+		r.AddMatched(jobId, 1)
+		r.AddFile(jobId, "/in/ok.csv", FileStatusTransferred, nil, 1, 1, time.Now())
+	}
+	failed := func(r *RunReport, jobId int) {
+		r.AddMatched(jobId, 1)
+		r.AddFailure(jobId, "/in/bad.csv", "transfer", errors.New("disk full"), 1, 0, time.Now())
+	}
+	skipped := func(r *RunReport, jobId int) {
+		r.AddMatched(jobId, 1)
+		r.AddFile(jobId, "/in/old.csv", FileStatusSkippedProcessed, nil, 0, 0, time.Now())
+	}
+	matchedNothing := func(r *RunReport, jobId int) { r.AddMatched(jobId, 0) }
+	locked := func(r *RunReport, jobId int) { r.JobLocked(jobId, "pid 42 on host1") }
+	jobFailed := func(r *RunReport, jobId int) { r.JobFailed(jobId, errors.New("source missing")) }
+
+	for _, test := range []struct {
+		name string
+		jobs []func(*RunReport, int)
+		want int
+	}{
+		{"every job transferred", []func(*RunReport, int){transferred, transferred}, ExitSuccess},
+		{"no job", nil, ExitNothingToDo},
+		{"only skipped files", []func(*RunReport, int){skipped}, ExitNothingToDo},
+		{"a job matched nothing", []func(*RunReport, int){transferred, matchedNothing}, ExitNothingToDo},
+		{"every file failed", []func(*RunReport, int){failed}, ExitTotalFailure},
+		{"job failed before its files", []func(*RunReport, int){jobFailed}, ExitTotalFailure},
+		{"some files failed", []func(*RunReport, int){transferred, failed}, ExitPartialFailure},
+		{"a job failed", []func(*RunReport, int){transferred, jobFailed}, ExitPartialFailure},
+		{"a job locked", []func(*RunReport, int){transferred, locked}, ExitLocked},
+		{"every job locked", []func(*RunReport, int){locked, locked}, ExitLocked},
+		{"locked before nothing to do", []func(*RunReport, int){matchedNothing, locked}, ExitLocked},
+		{"partial failure before locked", []func(*RunReport, int){transferred, failed, locked}, ExitPartialFailure},
+		{"total failure before locked", []func(*RunReport, int){failed, locked}, ExitTotalFailure},
+		{"failure before nothing to do", []func(*RunReport, int){transferred, failed, matchedNothing}, ExitPartialFailure},
+	} {
+		report := NewRunReport("FUPM")
+		for i, job := range test.jobs {
+			job(report, i+1)
+		}
+		report.Finish()
+		if got := report.ExitCode(); got != test.want {
+			t.Errorf("%s: exit code %d, want %d", test.name, got, test.want)
+		}
+	}
+}
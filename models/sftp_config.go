@@ -0,0 +1,11 @@
+package models
+
+type SftpConfig struct {
+	Host           string `json:"host"`
+	Port           int    `json:"port"`
+	User           string `json:"user"`
+	Password       string `json:"password"`
+	KeyPath        string `json:"key_path"`
+	KeyPassphrase  string `json:"key_passphrase"`
+	KnownHostsPath string `json:"known_hosts_path"`
+}
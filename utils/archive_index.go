@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zip"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ArchiveIndexFileName is kept at the root of the archives, it holds the manifest lines of every backup folder
+const ArchiveIndexFileName = "archive-index.jsonl"
+
+// AppendArchiveIndex adds the entry to the index at the archive root, the archiver keeps it up to date as it goes
+func AppendArchiveIndex(fs afero.Fs, root string, entry models.ManifestEntry) error {
+	return appendJSONLine(fs, filepath.Join(root, ArchiveIndexFileName), entry)
+}
+
+// ReadArchiveIndex streams the entries of the index at the archive root to fn until it returns false.
+// The error wraps os.ErrNotExist when the root has no index yet.
+func ReadArchiveIndex(ctx context.Context, fs afero.Fs, root string, fn func(models.ManifestEntry) bool) error {
+	path := filepath.Join(root, ArchiveIndexFileName)
+	file, err := openJSONLines(fs, path)
+	if err != nil {
+		return fmt.Errorf("failed to open archive index %s: %w", DescribeLocation(fs, path), err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(NewContextReader(ctx, file))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry models.ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Warn().Err(err).Msgf("skipping unreadable line %d of archive index %s", line, DescribeLocation(fs, path))
+			continue
+		}
+		if !fn(entry) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read archive index %s: %w", DescribeLocation(fs, path), err)
+	}
+	return nil
+}
+
+// RebuildArchiveIndex writes the index at the archive root again from the manifests of the backup folders.
+// Archives from before manifests existed are indexed from the source recorded in the zip, or their name when encrypted.
+// Locally, lines appended by an archiver while the rebuild runs may be lost, the next rebuild brings them back.
+// On object storage the parts appended so far are folded into the index, later ones are kept.
+func RebuildArchiveIndex(ctx context.Context, fs afero.Fs, root string) (int, error) {
+	path := filepath.Join(root, ArchiveIndexFileName)
+	// listed before the walk, their manifest lines are written first so the walk finds them
+	foldedParts, err := jsonLinesParts(fs, path)
+	if err != nil {
+		return 0, err
+	}
+
+	type folderContent struct {
+		manifest []models.ManifestEntry
+		archives []string
+	}
+	folders := make(map[string]*folderContent)
+	folderOf := func(dir string) *folderContent {
+		if folders[dir] == nil {
+			folders[dir] = &folderContent{}
+		}
+		return folders[dir]
+	}
+
+	manifestRead := make(map[string]bool)
+	readManifest := func(dir string) error {
+		if manifestRead[dir] {
+			return nil
+		}
+		manifestRead[dir] = true
+		entries, err := ReadManifest(fs, dir)
+		if err != nil {
+			return err
+		}
+		folder := folderOf(dir)
+		folder.manifest = append(folder.manifest, entries...)
+		return nil
+	}
+
+	err = afero.Walk(fs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		name := info.Name()
+		switch {
+		case info.IsDir() && name == ManifestFileName+jsonLinesPartsSuffix:
+			// the manifest of the folder may only have parts yet
+			if err := readManifest(filepath.Dir(path)); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		case info.IsDir() && name == ArchiveIndexFileName+jsonLinesPartsSuffix:
+			return filepath.SkipDir
+		case info.IsDir():
+		case name == ManifestFileName:
+			if err := readManifest(filepath.Dir(path)); err != nil {
+				return err
+			}
+		case strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".zip"+EncryptedFileExtension):
+			folder := folderOf(filepath.Dir(path))
+			folder.archives = append(folder.archives, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to walk %s: %w", DescribeLocation(fs, root), err)
+	}
+
+	dirs := make([]string, 0, len(folders))
+	for dir := range folders {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var index bytes.Buffer
+	count := 0
+	add := func(entry models.ManifestEntry) {
+		line, _ := json.Marshal(entry)
+		index.Write(append(line, '\n'))
+		count++
+	}
+	for _, dir := range dirs {
+		relative, _ := filepath.Rel(root, dir)
+		indexed := make(map[string]bool)
+		for _, entry := range folders[dir].manifest {
+			if entry.Folder == "" {
+				entry.Folder = relative
+			}
+			indexed[entry.Archive] = true
+			add(entry)
+		}
+		for _, archive := range folders[dir].archives {
+			if !indexed[filepath.Base(archive)] {
+				add(unlistedArchiveEntry(fs, archive, relative))
+			}
+		}
+	}
+
+	tmpPath := path + ".tmp"
+	if err := afero.WriteFile(fs, tmpPath, index.Bytes(), 0644); err != nil {
+		return 0, fmt.Errorf("failed to write archive index %s: %w", DescribeLocation(fs, tmpPath), err)
+	}
+	if err := fs.Rename(tmpPath, path); err != nil {
+		return 0, fmt.Errorf("failed to move archive index into place %s: %w", DescribeLocation(fs, path), err)
+	}
+	for _, part := range foldedParts {
+		if err := fs.Remove(part); err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Msgf("unable to remove %s, its entry is listed twice until the next rebuild", DescribeLocation(fs, part))
+		}
+	}
+	return count, nil
+}
+
+// unlistedArchiveEntry describes an archive missing from the manifest of its folder
+func unlistedArchiveEntry(fs afero.Fs, archive, folder string) models.ManifestEntry {
+	entry := models.ManifestEntry{
+		Archive:    filepath.Base(archive),
+		Folder:     folder,
+		SourcePath: strings.TrimSuffix(strings.TrimSuffix(filepath.Base(archive), EncryptedFileExtension), ".zip"),
+		Encrypted:  strings.HasSuffix(archive, EncryptedFileExtension),
+	}
+	info, err := fs.Stat(archive)
+	if err != nil {
+		return entry
+	}
+	entry.ArchiveSize = info.Size()
+	entry.ModTime = info.ModTime()
+	if entry.Encrypted {
+		return entry
+	}
+
+	file, err := fs.Open(archive)
+	if err != nil {
+		return entry
+	}
+	defer file.Close()
+	reader, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		log.Warn().Err(err).Msgf("unable to read archive %s for the index", DescribeLocation(fs, archive))
+		return entry
+	}
+	for _, zipEntry := range reader.File {
+		if zipEntry.FileInfo().IsDir() {
+			continue
+		}
+		entry.SourcePath = zipEntry.Name
+		if zipEntry.Comment != "" {
+			entry.SourcePath = zipEntry.Comment
+		}
+		entry.Size = int64(zipEntry.UncompressedSize64)
+		// zips written without a time hold the 1979 MS-DOS zero date
+		if zipEntry.Modified.Year() >= 1980 {
+			entry.ModTime = zipEntry.Modified
+		}
+		break
+	}
+	return entry
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"errors"
+	"fmt"
+	"github.com/spf13/afero"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrArchiveExists is returned by the fail collision policy
+var ErrArchiveExists = errors.New("archive already exists")
+
+// reservedArchives holds the archive paths being written, routines of every job share it
+var reservedArchives = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// reserveArchivePath picks the path of the archive following the job collision policy, ext being .zip or .zip.age.
+// The path is held until release is called, so two routines never write the same archive.
+func (run *archiveJobRun) reserveArchivePath(backupPath, archiveName, ext, file string, modTime time.Time) (string, func(), error) {
+	// claim holds the path unless another routine does, then looks for it on the storage outside the lock,
+	// on object storage that is a request. A path found there is let go unless it is to be overwritten.
+	claim := func(path string, overwrite bool) (bool, error) {
+		key := DescribeLocation(run.targetFs, path)
+		if !reserveArchiveKey(key) {
+			return false, nil
+		}
+		exists, err := afero.Exists(run.targetFs, path)
+		if err == nil && (!exists || overwrite) {
+			return true, nil
+		}
+		releaseArchiveKey(key)
+		return false, err
+	}
+
+	path := filepath.Join(backupPath, archiveName+ext)
+	// only archives of earlier runs are overwritten, one being written right now is versioned
+	claimed, err := claim(path, run.job.OnCollision == models.OnCollisionOverwrite)
+	if err == nil && !claimed {
+		switch run.job.OnCollision {
+		case models.OnCollisionFail:
+			return "", nil, fmt.Errorf("%w: %s", ErrArchiveExists, DescribeLocation(run.targetFs, path))
+		case models.OnCollisionTimestamp:
+			archiveName += "." + modTime.Format("20060102-150405")
+			path = filepath.Join(backupPath, archiveName+ext)
+			claimed, err = claim(path, false)
+		case models.OnCollisionPrefix:
+			archiveName = sourcePrefix(run.sourceFs, file) + "_" + archiveName
+			path = filepath.Join(backupPath, archiveName+ext)
+			claimed, err = claim(path, false)
+		}
+	}
+	// versions also settle timestamped and prefixed names that are taken as well
+	for version := 1; !claimed && err == nil; version++ {
+		path = filepath.Join(backupPath, archiveName+"."+strconv.Itoa(version)+ext)
+		claimed, err = claim(path, false)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := DescribeLocation(run.targetFs, path)
+	return path, func() { releaseArchiveKey(key) }, nil
+}
+
+// reserveArchiveKey holds the archive for the calling routine, false when another one holds it
+func reserveArchiveKey(key string) bool {
+	reservedArchives.Lock()
+	defer reservedArchives.Unlock()
+	if reservedArchives.paths[key] {
+		return false
+	}
+	reservedArchives.paths[key] = true
+	return true
+}
+
+func releaseArchiveKey(key string) {
+	reservedArchives.Lock()
+	delete(reservedArchives.paths, key)
+	reservedArchives.Unlock()
+}
+
+// sourcePrefix flattens the folder of the file into a name prefix, /var/log/app gives var_log_app
+func sourcePrefix(fs afero.Fs, file string) string {
+	folder := strings.TrimPrefix(SourceLocation(fs, filepath.Dir(file)), S3Scheme)
+	return strings.Trim(strings.NewReplacer("/", "_", "\\", "_", ":", "").Replace(folder), "_")
+}
+
+// SourceLocation is the full location of a source file as recorded in its archive, absolute for local files
+func SourceLocation(fs afero.Fs, name string) string {
+	location := DescribeLocation(fs, name)
+	if IsS3URI(location) {
+		return location
+	}
+	if absolute, err := filepath.Abs(location); err == nil {
+		return absolute
+	}
+	return location
+}
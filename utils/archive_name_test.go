@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var archiveModTime = time.Date(2024, 3, 5, 10, 0, 0, 0, time.Local)
+
+// namingRun is an archive run of the policy over a backup folder already holding the archives
+func namingRun(t *testing.T, policy string, existing ...string) *archiveJobRun {
+	t.Helper()
+	fs := afero.NewMemMapFs()
+	for _, name := range existing {
+		if err := afero.WriteFile(fs, name, []byte("zip"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &archiveJobRun{job: models.ArchiveJob{OnCollision: policy}, sourceFs: fs, targetFs: fs}
+}
+
+func reserveName(t *testing.T, run *archiveJobRun) (string, func()) {
+	t.Helper()
+	path, release, err := run.reserveArchivePath("/dst", "app.log", ".zip", "/var/log/app/app.log", archiveModTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(release)
+	return path, release
+}
+
+func TestReserveArchivePathPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy   string
+		existing []string
+		want     []string // paths given to routines reserving one after the other, none released
+	}{
+		{models.OnCollisionVersion, nil, []string{"/dst/app.log.zip", "/dst/app.log.1.zip"}},
+		{models.OnCollisionVersion, []string{"/dst/app.log.zip", "/dst/app.log.1.zip"}, []string{"/dst/app.log.2.zip", "/dst/app.log.3.zip"}},
+		{models.OnCollisionTimestamp, []string{"/dst/app.log.zip"}, []string{"/dst/app.log.20240305-100000.zip", "/dst/app.log.20240305-100000.1.zip"}},
+		{models.OnCollisionTimestamp, []string{"/dst/app.log.zip", "/dst/app.log.20240305-100000.zip"}, []string{"/dst/app.log.20240305-100000.1.zip"}},
+		{models.OnCollisionPrefix, []string{"/dst/app.log.zip"}, []string{"/dst/var_log_app_app.log.zip", "/dst/var_log_app_app.log.1.zip"}},
+		{models.OnCollisionOverwrite, []string{"/dst/app.log.zip"}, []string{"/dst/app.log.zip", "/dst/app.log.1.zip"}},
+		{models.OnCollisionFail, nil, []string{"/dst/app.log.zip"}},
+	} {
+		t.Run(fmt.Sprintf("%s over %v", test.policy, test.existing), func(t *testing.T) {
+			run := namingRun(t, test.policy, test.existing...)
+			for i, want := range test.want {
+				if got, _ := reserveName(t, run); got != want {
+					t.Errorf("reservation %d got %s, want %s", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReserveArchivePathFailPolicy(t *testing.T) {
+	run := namingRun(t, models.OnCollisionFail, "/dst/app.log.zip")
+	if _, _, err := run.reserveArchivePath("/dst", "app.log", ".zip", "/var/log/app/app.log", archiveModTime); !errors.Is(err, ErrArchiveExists) {
+		t.Fatalf("got %v, want %v", err, ErrArchiveExists)
+	}
+
+	// an archive being written by another routine is a collision too
+	run = namingRun(t, models.OnCollisionFail)
+	reserveName(t, run)
+	if _, _, err := run.reserveArchivePath("/dst", "app.log", ".zip", "/var/log/app/app.log", archiveModTime); !errors.Is(err, ErrArchiveExists) {
+		t.Fatalf("got %v, want %v", err, ErrArchiveExists)
+	}
+}
+
+func TestReserveArchivePathReleases(t *testing.T) {
+	run := namingRun(t, models.OnCollisionVersion)
+	first, release := reserveName(t, run)
+	release()
+	if again, _ := reserveName(t, run); again != first {
+		t.Fatalf("released path not given again, got %s", again)
+	}
+}
+
+// slowStatFs blocks the lookups of one path until released, like a slow object storage
+type slowStatFs struct {
+	afero.Fs
+	path    string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (fs slowStatFs) Stat(name string) (os.FileInfo, error) {
+	if name == fs.path {
+		close(fs.started)
+		<-fs.release
+	}
+	return fs.Fs.Stat(name)
+}
+
+func TestReserveArchivePathLooksUpOutsideTheLock(t *testing.T) {
+	slow := slowStatFs{Fs: afero.NewMemMapFs(), path: "/slow/app.log.zip", started: make(chan struct{}), release: make(chan struct{})}
+	run := &archiveJobRun{job: models.ArchiveJob{OnCollision: models.OnCollisionVersion}, sourceFs: slow, targetFs: slow}
+	done := make(chan error)
+	go func() {
+		_, release, err := run.reserveArchivePath("/slow", "app.log", ".zip", "/var/log/app.log", archiveModTime)
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	<-slow.started
+
+	// another routine names its archive while the first lookup hangs
+	reserved := make(chan string)
+	go func() {
+		path, release, _ := run.reserveArchivePath("/dst", "app.log", ".zip", "/var/log/app.log", archiveModTime)
+		release()
+		reserved <- path
+	}()
+	select {
+	case path := <-reserved:
+		if path != "/dst/app.log.zip" {
+			t.Errorf("got %s", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("reservation blocked by the lookup of another routine")
+	}
+	close(slow.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
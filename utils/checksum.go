@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// ChecksumFileExtension is appended to a file name to build its checksum sidecar
+const ChecksumFileExtension = ".sha256"
+
+// FileChecksum returns the hex encoded SHA-256 of the file along with its size
+func FileChecksum(fs afero.Fs, path string) (string, int64, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open file %s for checksum: %w", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read file %s for checksum: %w", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// WriteChecksumFile writes a sha256sum compatible sidecar next to the given file
+func WriteChecksumFile(fs afero.Fs, path, checksum string) (string, error) {
+	sidecar := path + ChecksumFileExtension
+	content := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(path))
+	if err := afero.WriteFile(fs, sidecar, []byte(content), 0644); err != nil {
+		return "", fmt.Errorf("failed to write checksum file %s: %w", sidecar, err)
+	}
+	return sidecar, nil
+}
+
+// ContentDigest takes the SHA-256 and size of what is written to it, to checksum content while it is copied
+type ContentDigest struct {
+	hash hash.Hash
+	size int64
+}
+
+func NewContentDigest() *ContentDigest {
+	return &ContentDigest{hash: sha256.New()}
+}
+
+func (d *ContentDigest) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.hash.Write(p)
+}
+
+// Sum is the hex encoded SHA-256 of the content written so far
+func (d *ContentDigest) Sum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
+
+func (d *ContentDigest) Size() int64 {
+	return d.size
+}
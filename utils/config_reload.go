@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// configChangeDelay lets editors finish writing before the config file is read again
+const configChangeDelay = 500 * time.Millisecond
+
+// ConfigWatcher reports changes of the config file and SIGHUP. viper's own WatchConfig replaces the settings
+// as soon as the file changes, here the daemon reloads between runs so work in flight keeps its settings.
+type ConfigWatcher struct {
+	path    string
+	content []byte // content of the settings in use
+	changes chan string
+}
+
+// WatchConfig starts watching the config file viper was loaded from until ctx is done
+func WatchConfig(ctx context.Context) (*ConfigWatcher, error) {
+	path, err := filepath.Abs(viper.ConfigFileUsed())
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch config file %s: %w", path, err)
+	}
+	// editors and config management often replace the file, its folder is watched so the new file is seen
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch config folder %s: %w", filepath.Dir(path), err)
+	}
+
+	w := &ConfigWatcher{path: path, content: content, changes: make(chan string, 1)}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go w.watch(ctx, watcher, hangup)
+	log.Info().Msgf("watching %s for changes, SIGHUP reloads it too", path)
+	return w, nil
+}
+
+func (w *ConfigWatcher) watch(ctx context.Context, watcher *fsnotify.Watcher, hangup chan os.Signal) {
+	defer watcher.Close()
+	defer signal.Stop(hangup)
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			w.notify("SIGHUP")
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == w.path && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				settle = time.After(configChangeDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warn().Err(err).Msgf("error watching config file %s", w.path)
+		case <-settle:
+			settle = nil
+			w.notify("config file changed")
+		}
+	}
+}
+
+// notify queues a reload, one pending reload covers any later change
+func (w *ConfigWatcher) notify(reason string) {
+	select {
+	case w.changes <- reason:
+	default:
+	}
+}
+
+// Changes receives the reason of every reload to do
+func (w *ConfigWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+// Reload reads the config file into the settings and keeps it when validate accepts it, otherwise the settings
+// in use are put back. It must not run while a job does. Returns false when nothing was applied.
+func (w *ConfigWatcher) Reload(validate func() error) (bool, error) {
+	content, err := os.ReadFile(w.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read config file %s: %w", w.path, err)
+	}
+	if bytes.Equal(content, w.content) {
+		return false, nil
+	}
+
+	before := flattenSettings(viper.AllSettings())
+	err = viper.ReadConfig(bytes.NewReader(content))
+	if err == nil {
+		err = validate()
+	}
+	if err != nil {
+		if restoreErr := viper.ReadConfig(bytes.NewReader(w.content)); restoreErr != nil {
+			log.Error().Err(restoreErr).Msg("unable to restore the previous settings")
+		}
+		return false, fmt.Errorf("new settings rejected, keeping the previous ones: %w", err)
+	}
+	w.content = content
+	logSettingsDiff(before, flattenSettings(viper.AllSettings()))
+	return true, nil
+}
+
+// flattenSettings turns nested settings into KEY.SUB keys, values printed as strings
+func flattenSettings(settings map[string]any) map[string]string {
+	flat := make(map[string]string)
+	var walk func(prefix string, values map[string]any)
+	walk = func(prefix string, values map[string]any) {
+		for key, value := range values {
+			if nested, ok := value.(map[string]any); ok {
+				walk(prefix+key+".", nested)
+				continue
+			}
+			flat[strings.ToUpper(prefix+key)] = fmt.Sprint(value)
+		}
+	}
+	walk("", settings)
+	return flat
+}
+
+// logSettingsDiff logs every added, removed and changed setting, secrets are masked
+func logSettingsDiff(before, after map[string]string) {
+	keys := make(map[string]bool)
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	changed := 0
+	for _, key := range sorted {
+		old, hadOld := before[key]
+		value, hasNew := after[key]
+		switch {
+		case !hadOld:
+			log.Info().Msgf("setting %s added: %s", key, maskSetting(key, value))
+		case !hasNew:
+			log.Info().Msgf("setting %s removed", key)
+		case old != value:
+			log.Info().Msgf("setting %s changed: %s -> %s", key, maskSetting(key, old), maskSetting(key, value))
+		default:
+			continue
+		}
+		changed++
+	}
+	log.Info().Msgf("settings reloaded, %d changed", changed)
+}
+
+// maskSetting hides the value of passwords and other secrets
+func maskSetting(key, value string) string {
+	if IsSecretSetting(key) && value != "" {
+		return RedactedSecret
+	}
+	return value
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// loadSettingsFile writes the settings file and loads it like the program does at startup
+func loadSettingsFile(t *testing.T, content string) *ConfigWatcher {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "settings.env")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		viper.ReadConfig(strings.NewReader(""))
+		viper.SetConfigFile("")
+	})
+	return &ConfigWatcher{path: path, content: []byte(content), changes: make(chan string, 1)}
+}
+
+func rewriteSettingsFile(t *testing.T, w *ConfigWatcher, content string) {
+	t.Helper()
+	if err := os.WriteFile(w.path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func validLogLevel() error {
+	_, err := LogLevel()
+	return err
+}
+
+func TestConfigReloadRejectsInvalidSettings(t *testing.T) {
+	w := loadSettingsFile(t, "LOG_LEVEL=info\nARCHIVE_JOB_COUNT=1\n")
+
+	rewriteSettingsFile(t, w, "LOG_LEVEL=loud\nARCHIVE_JOB_COUNT=2\nSEARCH_PATH=/archives\n")
+	applied, err := w.Reload(validLogLevel)
+	if applied || err == nil || !strings.Contains(err.Error(), "LOG_LEVEL") {
+		t.Fatalf("invalid settings gave %t, %v", applied, err)
+	}
+	if viper.GetString("LOG_LEVEL") != "info" || viper.GetInt("ARCHIVE_JOB_COUNT") != 1 || viper.IsSet("SEARCH_PATH") {
+		t.Fatalf("previous settings not restored: %v", viper.AllSettings())
+	}
+
+	// the file is fixed, the settings it holds are taken
+	rewriteSettingsFile(t, w, "LOG_LEVEL=warn\nARCHIVE_JOB_COUNT=2\n")
+	if applied, err := w.Reload(validLogLevel); !applied || err != nil {
+		t.Fatalf("valid settings gave %t, %v", applied, err)
+	}
+	if viper.GetString("LOG_LEVEL") != "warn" || viper.GetInt("ARCHIVE_JOB_COUNT") != 2 {
+		t.Fatalf("new settings not applied: %v", viper.AllSettings())
+	}
+	if applied, err := w.Reload(validLogLevel); applied || err != nil {
+		t.Fatalf("unchanged file gave %t, %v", applied, err)
+	}
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// WithTimeout is context.WithTimeout where zero or less means no timeout
+func WithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// NewContextReader returns a reader failing with the context error once the context is done,
+// so a long io.Copy stops at the next chunk
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// GlobContext is afero.Glob giving up when the context is done, a glob stuck on a dead mount is left behind
+func GlobContext(ctx context.Context, fs afero.Fs, pattern string) ([]string, error) {
+	type globResult struct {
+		matches []string
+		err     error
+	}
+	result := make(chan globResult, 1)
+	go func() {
+		matches, err := afero.Glob(fs, pattern)
+		result <- globResult{matches, err}
+	}()
+
+	select {
+	case res := <-result:
+		return res.matches, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
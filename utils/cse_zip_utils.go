@@ -1,61 +1,110 @@
 package utils
 
 import (
+	"context"
+	"filippo.io/age"
 	"github.com/klauspost/compress/zip"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
 	"io"
-	"os"
 	"path/filepath"
 )
 
-func CreateZipArchive(zipFileName, sourceFile string, logger zerolog.Logger) error {
+func CreateZipArchive(ctx context.Context, fs afero.Fs, zipFileName string, sourceFs afero.Fs, sourceFile string, logger zerolog.Logger) error {
+	return CreateEncryptedZipArchive(ctx, fs, zipFileName, sourceFs, sourceFile, nil, nil, logger)
+}
+
+// CreateEncryptedZipArchive zips the source file and encrypts the zip for the recipients, no recipients writes a plain zip.
+// The copy stops with the context error once ctx is done. A non nil digest also receives the source content.
+func CreateEncryptedZipArchive(ctx context.Context, fs afero.Fs, zipFileName string, sourceFs afero.Fs, sourceFile string, recipients []age.Recipient, digest io.Writer, logger zerolog.Logger) error {
 	// Create a new zip file
-	zipFile, err := os.Create(zipFileName)
+	zipFile, err := fs.Create(zipFileName)
 	if err != nil {
 		return err
 	}
-	defer func(zipFile *os.File) {
-		err := zipFile.Close()
-		if err != nil {
-			logger.Err(err).Msg("error closing the zip file")
+
+	if len(recipients) == 0 {
+		err = WriteZipArchive(ctx, zipFile, sourceFs, sourceFile, digest, logger)
+	} else {
+		var encrypted io.WriteCloser
+		encrypted, err = EncryptWriter(zipFile, recipients)
+		if err == nil {
+			err = WriteZipArchive(ctx, encrypted, sourceFs, sourceFile, digest, logger)
+			// closing flushes the last encrypted chunk
+			if closeErr := encrypted.Close(); err == nil {
+				err = closeErr
+			}
 		}
-	}(zipFile)
+	}
 
-	// Create a zip writer
-	zipWriter := zip.NewWriter(zipFile)
-	defer func(zipWriter *zip.Writer) {
-		err := zipWriter.Close()
-		if err != nil {
-			log.Err(err).Msg("error closing the zip writer")
+	if err != nil {
+		// an upload of a broken zip is cancelled rather than completed
+		AbortFile(zipFile, err)
+		return err
+	}
+	// closing completes the upload on object storage, so its error counts
+	if closeErr := zipFile.Close(); closeErr != nil {
+		logger.Err(closeErr).Msg("error closing the zip file")
+		if err == nil {
+			err = closeErr
 		}
-	}(zipWriter)
+	}
+	return err
+}
+
+// WriteZipArchive writes a zip holding the source file to any writer, a local file or an upload stream
+func WriteZipArchive(ctx context.Context, w io.Writer, sourceFs afero.Fs, sourceFile string, digest io.Writer, logger zerolog.Logger) error {
+	zipWriter := zip.NewWriter(w)
 
 	// Add the log file to the zip archive
-	return AddFileToZip(zipWriter, sourceFile, "", logger)
+	if err := AddFileToZip(ctx, zipWriter, sourceFs, sourceFile, "", digest, logger); err != nil {
+		zipWriter.Close()
+		return err
+	}
+
+	err := zipWriter.Close()
+	if err != nil {
+		logger.Err(err).Msg("error closing the zip writer")
+	}
+	return err
 }
 
-func AddFileToZip(zipWriter *zip.Writer, filePath, baseDir string, logger zerolog.Logger) error {
-	file, err := os.Open(filePath)
+func AddFileToZip(ctx context.Context, zipWriter *zip.Writer, sourceFs afero.Fs, filePath, baseDir string, digest io.Writer, logger zerolog.Logger) error {
+	file, err := sourceFs.Open(filePath)
 	if err != nil {
 		return err
 	}
-	defer func(file *os.File) {
+	defer func(file afero.File) {
 		err := file.Close()
 		if err != nil {
 			logger.Err(err).Msg("error closing the file")
 		}
 	}(file)
 
-	// Create a header for the file in the zip archive
-	zipFile, err := zipWriter.Create(filepath.Join(baseDir, filepath.Base(filePath)))
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// Create a header for the file in the zip archive, it keeps the modification time and, as comment, where the file came from
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Join(baseDir, filepath.Base(filePath))
+	header.Method = zip.Deflate
+	header.Comment = SourceLocation(sourceFs, filePath)
+	zipFile, err := zipWriter.CreateHeader(header)
 	if err != nil {
 		logger.Err(err).Msg("error creating the zip file")
 		return err
 	}
 
 	// Copy the file content to the zip archive
-	_, err = io.Copy(zipFile, file)
+	var content io.Reader = NewContextReader(ctx, file)
+	if digest != nil {
+		content = io.TeeReader(content, digest)
+	}
+	_, err = io.Copy(zipFile, content)
 	if err != nil {
 		logger.Err(err).Msg("error creating the zip file")
 	}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+)
+
+// EncryptedFileExtension is appended to files encrypted with age
+const EncryptedFileExtension = ".age"
+
+// LoadRecipients reads age public keys (one per line, # comments allowed) from the given file
+func LoadRecipients(path string) ([]age.Recipient, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recipients file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	recipients, err := age.ParseRecipients(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse recipients file %s: %w", path, err)
+	}
+	return recipients, nil
+}
+
+// LoadIdentities reads age private keys from the given file
+func LoadIdentities(path string) ([]age.Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open identity file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity file %s: %w", path, err)
+	}
+	return identities, nil
+}
+
+// EncryptWriter wraps w so everything written is encrypted, it must be closed before w
+func EncryptWriter(w io.Writer, recipients []age.Recipient) (io.WriteCloser, error) {
+	encrypted, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start encryption: %w", err)
+	}
+	return encrypted, nil
+}
+
+// DecryptReader wraps r so everything read is decrypted with the first matching identity
+func DecryptReader(r io.Reader, identities []age.Identity) (io.Reader, error) {
+	decrypted, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start decryption: %w", err)
+	}
+	return decrypted, nil
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// fileNameDatePattern finds a YYYYMMDD or YYYY-MM-DD date not preceded by a digit, a time may follow it
+var fileNameDatePattern = regexp.MustCompile(`(?:^|\D)((?:19|20)\d{2})-?(0[1-9]|1[0-2])-?(0[1-9]|[12]\d|3[01])`)
+
+// dateFormatTokens are the tokens of a file name date format, longest first, with their go layout and digits
+var dateFormatTokens = []struct {
+	token  string
+	layout string
+	digits string
+}{
+	{"YYYY", "2006", `\d{4}`},
+	{"YY", "06", `\d{2}`},
+	{"MM", "01", `\d{2}`},
+	{"DD", "02", `\d{2}`},
+	{"hh", "15", `\d{2}`},
+	{"mm", "04", `\d{2}`},
+	{"ss", "05", `\d{2}`},
+}
+
+// DateFromFileName returns the first valid date in the file name, in local time
+func DateFromFileName(name string) (time.Time, bool) {
+	for _, match := range fileNameDatePattern.FindAllStringSubmatch(name, -1) {
+		date, err := time.ParseInLocation("20060102", match[1]+match[2]+match[3], time.Local)
+		if err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// FileNameDateRule pulls a business date out of file names, e.g. format YYYYMMDDhhmmss with
+// regex RECON_FILE_\d+_(\d{14}) for RECON_FILE_1016_20250706101010.txt
+type FileNameDateRule struct {
+	pattern *regexp.Regexp
+	layout  string
+}
+
+// NewFileNameDateRule builds a rule from a token format (YYYY YY MM DD hh mm ss, anything else is literal)
+// and an optional regex whose first group, or whole match, holds the date. Without a regex the format is searched in the name.
+func NewFileNameDateRule(format, expression string) (*FileNameDateRule, error) {
+	if format == "" {
+		format = "YYYYMMDD"
+	}
+	var layout, digits strings.Builder
+	hasYear, hasMonth := false, false
+	for rest := format; rest != ""; {
+		matched := false
+		for _, t := range dateFormatTokens {
+			if strings.HasPrefix(rest, t.token) {
+				layout.WriteString(t.layout)
+				digits.WriteString(t.digits)
+				hasYear = hasYear || t.token == "YYYY" || t.token == "YY"
+				hasMonth = hasMonth || t.token == "MM"
+				rest = rest[len(t.token):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			layout.WriteString(rest[:1])
+			digits.WriteString(regexp.QuoteMeta(rest[:1]))
+			rest = rest[1:]
+		}
+	}
+	if !hasYear || !hasMonth {
+		return nil, fmt.Errorf("date format %s needs at least a year (YYYY or YY) and a month (MM)", format)
+	}
+
+	if expression == "" {
+		expression = `(?:^|\D)(` + digits.String() + `)`
+	}
+	pattern, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date regex %s: %w", expression, err)
+	}
+	return &FileNameDateRule{pattern: pattern, layout: layout.String()}, nil
+}
+
+// Date returns the first date of the name the rule can parse, in local time
+func (r *FileNameDateRule) Date(name string) (time.Time, bool) {
+	for _, match := range r.pattern.FindAllStringSubmatch(name, -1) {
+		value := match[0]
+		if len(match) > 1 {
+			value = match[1]
+		}
+		if date, err := time.ParseInLocation(r.layout, value, time.Local); err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
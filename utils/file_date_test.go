@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileNameDateRule(t *testing.T) {
+	july6 := time.Date(2025, 7, 6, 0, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		format, expression, name string
+		want                     time.Time // zero when no date is found
+	}{
+		{"", "", "app_20250706.log", july6},
+		{"YYYYMMDDhhmmss", `RECON_FILE_\d+_(\d{14})`, "RECON_FILE_1016_20250706101010.txt", july6.Add(10*time.Hour + 10*time.Minute + 10*time.Second)},
+		{"YYMMDD", "", "app_250706.log", july6},
+		{"DD-MM-YYYY", "", "report 06-07-2025.csv", july6},
+		// a regex without a group gives the date in its whole match
+		{"YYYYMMDD", `\d{8}`, "app_20250706.log", july6},
+		{"YYYYMMDD", `app_\d{8}`, "app_20250706.log", time.Time{}},
+		// the first group is the date, later groups are ignored
+		{"YYYYMMDD", `(\d{8})_(\d+)`, "app_20250706_1016.log", july6},
+		// an invalid date is passed over for the next match
+		{"YYYYMMDD", "", "app_20251399_20250706.log", july6},
+		{"YYYYMMDD", "", "app_1016.log", time.Time{}},
+		{"YYYYMMDD", `RECON_(\d{8})`, "app_20250706.log", time.Time{}},
+	} {
+		rule, err := NewFileNameDateRule(test.format, test.expression)
+		if err != nil {
+			t.Errorf("NewFileNameDateRule(%q, %q): %v", test.format, test.expression, err)
+			continue
+		}
+		date, ok := rule.Date(test.name)
+		if ok != !test.want.IsZero() || !date.Equal(test.want) {
+			t.Errorf("format %q regex %q on %s gave %s, %t, want %s", test.format, test.expression, test.name, date, ok, test.want)
+		}
+	}
+
+	for _, test := range []struct{ format, expression string }{
+		{"DDMM", ""},
+		{"YYYY", ""},
+		{"MMDD", `(\d{4})`},
+		{"YYYYMMDD", `(\d{8}`},
+	} {
+		if _, err := NewFileNameDateRule(test.format, test.expression); err == nil {
+			t.Errorf("NewFileNameDateRule(%q, %q) accepted", test.format, test.expression)
+		}
+	}
+}
+
+func TestDateFromFileName(t *testing.T) {
+	july6 := time.Date(2025, 7, 6, 0, 0, 0, 0, time.Local)
+	for name, want := range map[string]time.Time{
+		"app_20250706.log":        july6,
+		"app-2025-07-06.log":      july6,
+		"20250706101010.log":      july6,
+		"app_120250706.log":       {},
+		"app_20251306.log":        {},
+		"app_20250231_20250706.x": july6,
+		"app.log":                 {},
+	} {
+		date, ok := DateFromFileName(name)
+		if ok != !want.IsZero() || !date.Equal(want) {
+			t.Errorf("DateFromFileName(%s) = %s, %t, want %s", name, date, ok, want)
+		}
+	}
+}
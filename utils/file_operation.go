@@ -2,107 +2,467 @@ package utils
 
 import (
 	"CSEFileManager/models"
+	"context"
+	"filippo.io/age"
 	"fmt"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
+	"github.com/spf13/afero"
 	"github.com/spf13/viper"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-func WalkDirectoryAndProcessFiles(jobs []models.ArchiveJob) {
-	var filePatterns []string
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, viper.GetInt("ARCHIVE_JOB_MAX_ROUTINES")) // buffered channel to limit concurrency
+// archiveJobRun is what the files of one job share during a walk
+type archiveJobRun struct {
+	job        models.ArchiveJob
+	ctx        context.Context
+	logger     zerolog.Logger // carries the job_id and run_id
+	sourceFs   afero.Fs
+	targetFs   afero.Fs
+	sourceRoot string
+	targetRoot string
+	host       string
+	runDate    time.Time
+	recipients []age.Recipient
+	files      []string          // matched files not handed to a routine yet
+	overflow   map[string]bool   // files past the KeepUnarchived newest ones
+	openFiles  OpenFiles         // files held open by other processes when the job started
+	nameDate   *FileNameDateRule // nil finds any YYYYMMDD date in the name
+}
+
+type archiveTask struct {
+	run  *archiveJobRun
+	file string
+}
 
+// WalkDirectoryAndProcessFiles matches the files of every job, then feeds them to ARCHIVE_JOB_MAX_ROUTINES routines,
+// taking one file of each job in turn. Jobs not started or not finished when ctx is done are failed.
+func WalkDirectoryAndProcessFiles(ctx context.Context, jobs []models.ArchiveJob, report *models.RunReport) {
+	var runs []*archiveJobRun
 	for _, job := range jobs {
-		log.Info().Msgf("starting job %d", job.JobId)
-		filePatterns = strings.Split(job.FilePattern, job.FilePatternSeparator)
+		logger := JobLogger(report, job.JobId, job.LogLevel)
+		if err := ctx.Err(); err != nil {
+			logger.Warn().Msgf("not starting job %d: %v", job.JobId, err)
+			report.JobFailed(job.JobId, fmt.Errorf("job not started: %w", err))
+			continue
+		}
+		logger.Info().Msgf("starting job %d", job.JobId)
+		// the job timeout runs from here until its last file is done
+		jobCtx, cancel := WithTimeout(ctx, job.JobTimeout)
+		defer cancel()
 
-		for _, filePattern := range filePatterns {
-			log.Info().Msgf("searching files with pattern %s", filePattern)
+		if run := prepareArchiveJob(jobCtx, job, report, logger); run != nil {
+			runs = append(runs, run)
+		}
+	}
 
-			files, err := filepath.Glob(filepath.Join(job.ArchiveFromPath, filePattern))
-			if err != nil {
-				log.Error().Err(err).Msgf("error searching files with pattern %s", filePattern)
-				continue
+	tasks := make(chan archiveTask)
+	var wg sync.WaitGroup
+	for i := 1; i <= viper.GetInt("ARCHIVE_JOB_MAX_ROUTINES"); i++ {
+		wg.Add(1)
+		go func(routineName string) {
+			defer wg.Done()
+			for task := range tasks {
+				archiveFile(task.run, task.file, routineName, report)
 			}
+		}(fmt.Sprintf("ROUTINE_%d", i))
+	}
 
-			if len(files) == 0 {
-				log.Info().Msgf("no files found with pattern %s", filePattern)
+	// round robin, so a job with thousands of files does not hold back the others
+	for pending := true; pending; {
+		pending = false
+		for _, run := range runs {
+			if len(run.files) == 0 {
 				continue
-			} else {
-				log.Info().Msgf("found %d files with pattern %s", len(files), filePattern)
 			}
-
-			// start file processing
-			wg.Add(1)
-			semaphore <- struct{}{} // acquire a slot
-			routineName := fmt.Sprintf("ROUTINE_%d", job.JobId)
-			go func(files []string, routine string, job models.ArchiveJob) {
-				defer wg.Done()
-				defer func() { <-semaphore }() // release slot
-
-				ProcessFiles(files, routine, job)
-			}(files, routineName, job)
+			if err := run.ctx.Err(); err != nil {
+				run.logger.Warn().Msgf("stopping job %d with %d files left: %v", run.job.JobId, len(run.files), err)
+				report.JobFailed(run.job.JobId, fmt.Errorf("stopped before %s: %w", run.files[0], err))
+				run.files = nil
+				continue
+			}
+			select {
+			case tasks <- archiveTask{run: run, file: run.files[0]}:
+				run.files = run.files[1:]
+			case <-run.ctx.Done(): // recorded on the next round
+			}
+			pending = pending || len(run.files) > 0
 		}
 	}
+	close(tasks)
 	wg.Wait() // wait for all goroutines to finish
 }
 
-func ProcessFiles(files []string, routineName string, job models.ArchiveJob) {
-	logger := log.With().Str("routine", routineName).Logger()
-	for _, file := range files {
-		logger.Info().Msgf("processing file %s", file)
-		fileInfo, err := os.Stat(file)
+// prepareArchiveJob opens the storages of the job and matches its files, a file matched by several patterns is kept once.
+// A nil run means the job failed and is already reported.
+func prepareArchiveJob(ctx context.Context, job models.ArchiveJob, report *models.RunReport, logger zerolog.Logger) *archiveJobRun {
+	sourceFs, sourceRoot, err := ResolveStorage(job.ArchiveFromPath)
+	if err != nil {
+		logger.Error().Err(err).Msgf("unable to open archive source %s for job %d", job.ArchiveFromPath, job.JobId)
+		report.JobFailed(job.JobId, err)
+		return nil
+	}
+	targetFs, targetRoot, err := ResolveStorage(job.ArchiveToPath)
+	if err != nil {
+		logger.Error().Err(err).Msgf("unable to open archive target %s for job %d", job.ArchiveToPath, job.JobId)
+		report.JobFailed(job.JobId, err)
+		return nil
+	}
+	host, _ := os.Hostname()
+	run := &archiveJobRun{job: job, ctx: ctx, logger: logger, sourceFs: sourceFs, targetFs: targetFs, sourceRoot: sourceRoot, targetRoot: targetRoot,
+		host: host, runDate: time.Now()}
+
+	if job.NameDateFormat != "" || job.NameDateRegex != "" {
+		if run.nameDate, err = NewFileNameDateRule(job.NameDateFormat, job.NameDateRegex); err != nil {
+			logger.Error().Err(err).Msgf("invalid file name date rule for job %d, no file will be archived", job.JobId)
+			report.JobFailed(job.JobId, err)
+			return nil
+		}
+	}
+
+	if job.EncryptRecipients != "" {
+		run.recipients, err = LoadRecipients(job.EncryptRecipients)
 		if err != nil {
-			logger.Err(err).Msg("unable to get file info, skipping.....")
-			continue
+			logger.Error().Err(err).Msgf("unable to load encryption recipients for job %d, no file will be archived", job.JobId)
+			report.JobFailed(job.JobId, err)
+			return nil
 		}
+	}
 
-		if fileInfo.IsDir() {
-			logger.Info().Msgf("file %s is directory..skipping", fileInfo.Name())
+	seen := make(map[string]bool)
+	for _, filePattern := range strings.Split(job.FilePattern, job.FilePatternSeparator) {
+		logger.Info().Msgf("searching files with pattern %s", filePattern)
+
+		files, err := GlobContext(ctx, sourceFs, filepath.Join(sourceRoot, filePattern))
+		if err != nil {
+			logger.Error().Err(err).Msgf("error searching files with pattern %s", filePattern)
+			report.JobFailed(job.JobId, fmt.Errorf("error searching files with pattern %s: %w", filePattern, err))
 			continue
 		}
 
-		// do not process if the last mod time is lesser than what is given in property
-		if job.ArchiveIfOlderThan != 0 {
-			hoursDiff := time.Since(fileInfo.ModTime()).Hours()
-			if hoursDiff < float64(job.ArchiveIfOlderThan) {
-				log.Warn().Msgf("%s last mod time doesn't meet the criteria, last mod time %s skipping...", file, fileInfo.ModTime())
+		duplicates := 0
+		for _, file := range files {
+			if seen[file] {
+				duplicates++
 				continue
 			}
+			seen[file] = true
+			run.files = append(run.files, file)
+		}
+		if len(files) == 0 {
+			logger.Info().Msgf("no files found with pattern %s", filePattern)
+		} else {
+			logger.Info().Msgf("found %d files with pattern %s, %d already matched by another pattern", len(files), filePattern, duplicates)
 		}
+	}
+	report.AddMatched(job.JobId, len(run.files))
+	if job.KeepUnarchived > 0 {
+		run.markOverflow()
+	}
+	// copytruncate is meant for files held open, there is nothing to detect
+	if !job.IncludeOpenFiles && job.OriginalFile != models.OriginalFileTruncate && len(run.files) > 0 {
+		if canDetectOpenFiles(sourceFs) {
+			if run.openFiles, err = ScanOpenFiles(); err != nil {
+				logger.Warn().Err(err).Msgf("unable to list open files for job %d, files still being written may be archived", job.JobId)
+			}
+		} else {
+			logger.Debug().Msgf("open files cannot be detected for the source of job %d", job.JobId)
+		}
+	}
+	return run
+}
 
-		lastModDate := fileInfo.ModTime().Format("2006-01-02")
-		logger.Info().Msgf("creating backup folder with date %s", lastModDate)
-		backupPath, err := CreateBackupFolder(job.ArchiveToPath, lastModDate, logger)
-		if err != nil {
-			logger.Error().Err(err).Msgf("unable to create backup folder with date %s for file %s skipping...", lastModDate, file)
-			continue
+// archiveReason tells why the file is selected, an empty reason leaves it in place
+func archiveReason(run *archiveJobRun, file string, fileInfo os.FileInfo) string {
+	job := run.job
+	switch {
+	case job.ArchiveIfOlderThan == 0:
+		return "no age filter"
+	case time.Since(run.ageDate(file, fileInfo)) >= job.ArchiveIfOlderThan:
+		return fmt.Sprintf("older than %s", job.ArchiveIfOlderThan)
+	case job.ArchiveIfLargerThan > 0 && fileInfo.Size() >= job.ArchiveIfLargerThan:
+		return fmt.Sprintf("%d bytes, over the %d bytes threshold", fileInfo.Size(), job.ArchiveIfLargerThan)
+	case run.overflow[file]:
+		return fmt.Sprintf("more than %d files left unarchived", job.KeepUnarchived)
+	}
+	return ""
+}
+
+// markOverflow flags every file past the KeepUnarchived newest ones, they are archived whatever their age
+func (run *archiveJobRun) markOverflow() {
+	type matchedFile struct {
+		name string
+		date time.Time
+	}
+	var matched []matchedFile
+	for _, file := range run.files {
+		if info, err := run.sourceFs.Stat(file); err == nil && !info.IsDir() {
+			matched = append(matched, matchedFile{file, run.ageDate(file, info)})
 		}
+	}
+	if len(matched) <= run.job.KeepUnarchived {
+		return
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].date.After(matched[j].date) })
+	run.overflow = make(map[string]bool)
+	for _, file := range matched[run.job.KeepUnarchived:] {
+		run.overflow[file.name] = true
+	}
+	run.logger.Info().Msgf("job %d has %d files, the %d oldest are archived to keep %d", run.job.JobId, len(matched), len(run.overflow), run.job.KeepUnarchived)
+}
 
-		// create zip file
-		zipFileName := filepath.Join(backupPath, filepath.Base(file)+".zip")
-		err = CreateZipArchive(zipFileName, file, logger)
-		if err != nil {
-			logger.Err(err).Msgf("error creating archive %s", zipFileName)
-			continue
+// fileNameDate is the date in the name of the file, using the job rule when it has one
+func (run *archiveJobRun) fileNameDate(file string) (time.Time, bool) {
+	if run.nameDate != nil {
+		return run.nameDate.Date(filepath.Base(file))
+	}
+	return DateFromFileName(filepath.Base(file))
+}
+
+// ageDate is the date the age rules compare against: the name date for name dated jobs, the mtime otherwise
+func (run *archiveJobRun) ageDate(file string, fileInfo os.FileInfo) time.Time {
+	if run.job.DateSource == models.DateSourceFileName {
+		if date, ok := run.fileNameDate(file); ok {
+			return date
 		}
+		run.logger.Debug().Msgf("no date in the name of %s, using its modification time", file)
+	}
+	return fileInfo.ModTime()
+}
 
-		if job.DeleteOriginalFile {
-			logger.Info().Msgf("deleting original file %s", filepath.Base(file))
-			err = os.Remove(file)
-			if err != nil {
-				logger.Err(err).Msgf("unable to delete file %s after archive", file)
-				continue
+// fileDate is the date placing the file in its backup folder, as chosen by the job date source
+func (run *archiveJobRun) fileDate(file string, fileInfo os.FileInfo) time.Time {
+	if run.job.DateSource == models.DateSourceRun {
+		return run.runDate
+	}
+	return run.ageDate(file, fileInfo)
+}
+
+// backupFolder renders the job folder layout for the file, relative to the archive root
+func (run *archiveJobRun) backupFolder(file string, date time.Time) string {
+	subdir, err := filepath.Rel(run.sourceRoot, filepath.Dir(file))
+	if err != nil || subdir == "." || strings.HasPrefix(subdir, "..") {
+		subdir = ""
+	}
+	return RenderFolderLayout(run.job.FolderLayout, date, BackupFolderVars{
+		Host:         run.host,
+		Job:          strconv.Itoa(run.job.JobId),
+		SourceSubdir: subdir,
+	})
+}
+
+// archiveFile zips one file of the job into its backup folder
+func archiveFile(run *archiveJobRun, file, routineName string, report *models.RunReport) {
+	job, sourceFs, targetFs := run.job, run.sourceFs, run.targetFs
+	logger := run.logger.With().Str("routine", routineName).Str("file", file).Logger()
+	start := time.Now()
+	if err := run.ctx.Err(); err != nil {
+		report.JobFailed(job.JobId, fmt.Errorf("stopped before %s: %w", file, err))
+		return
+	}
+
+	logger.Info().Msgf("processing file %s of job %d", file, job.JobId)
+	fileInfo, err := sourceFs.Stat(file)
+	if err != nil {
+		logger.Err(err).Msg("unable to get file info, skipping.....")
+		report.AddFailure(job.JobId, file, "stat", err, 0, 0, start)
+		return
+	}
+
+	if fileInfo.IsDir() {
+		logger.Info().Msgf("file %s is directory..skipping", fileInfo.Name())
+		report.AddFile(job.JobId, file, models.FileStatusSkippedDirectory, nil, 0, 0, start)
+		return
+	}
+
+	reason := archiveReason(run, file, fileInfo)
+	if reason == "" {
+		logger.Warn().Msgf("%s last mod time doesn't meet the criteria, last mod time %s skipping...", file, fileInfo.ModTime())
+		report.AddFile(job.JobId, file, models.FileStatusSkippedAge, nil, 0, 0, start)
+		return
+	}
+	logger.Info().Msgf("archiving %s: %s", file, reason)
+
+	// a file still being written would give a truncated archive, and deleting it leaves the writer on an unlinked inode
+	if pid := run.openFiles.OpenedBy(fileInfo); pid != 0 {
+		logger.Warn().Msgf("%s is open by process %d, skipping...", file, pid)
+		report.AddFile(job.JobId, file, models.FileStatusSkippedOpen, nil, 0, 0, start)
+		return
+	}
+
+	if job.OriginalFile == models.OriginalFileTruncate && fileInfo.Size() == 0 {
+		logger.Info().Msgf("%s is empty, nothing to archive", file)
+		report.AddFile(job.JobId, file, models.FileStatusSkippedEmpty, nil, 0, 0, start)
+		return
+	}
+
+	fileDate := run.fileDate(file, fileInfo)
+	folder := run.backupFolder(file, fileDate)
+	logger.Info().Msgf("creating backup folder %s with date %s", folder, fileDate.Format("2006-01-02"))
+	backupPath, err := CreateBackupFolder(targetFs, run.targetRoot, folder, logger)
+	if err != nil {
+		logger.Error().Err(err).Msgf("unable to create backup folder with date %s for file %s skipping...", fileDate.Format("2006-01-02"), file)
+		report.AddFailure(job.JobId, file, "backup_folder", err, fileInfo.Size(), 0, start)
+		return
+	}
+
+	// kept originals match again on every run, they are archived again only once their content changed
+	if job.OriginalFile == models.OriginalFileKeep {
+		if archive, ok := run.archivedUnchanged(backupPath, file, fileInfo, logger); ok {
+			logger.Info().Msgf("%s is unchanged since it was archived as %s, skipping...", file, archive)
+			report.AddFile(job.JobId, file, models.FileStatusSkippedProcessed, nil, 0, 0, start)
+			return
+		}
+	}
+
+	// create zip file
+	archiveName := filepath.Base(file)
+	if job.OriginalFile == models.OriginalFileTruncate {
+		// the same file is archived again on every run
+		archiveName += "." + start.Format("20060102-150405")
+	}
+	ext := ".zip"
+	if len(run.recipients) > 0 {
+		ext += EncryptedFileExtension
+	}
+	zipFileName, release, err := run.reserveArchivePath(backupPath, archiveName, ext, file, fileInfo.ModTime())
+	if err != nil {
+		logger.Err(err).Msgf("no archive name available for %s in %s, skipping...", file, DescribeLocation(targetFs, backupPath))
+		report.AddFailure(job.JobId, file, "collision", err, fileInfo.Size(), 0, start)
+		return
+	}
+	defer release()
+	if filepath.Base(zipFileName) != archiveName+ext {
+		logger.Info().Msgf("%s already exists, archiving as %s", archiveName+ext, filepath.Base(zipFileName))
+	}
+	// a started archive is finished on a stop, the file timeout alone bounds it
+	fileCtx, cancel := WithTimeout(context.WithoutCancel(run.ctx), job.FileTimeout)
+	digest := NewContentDigest()
+	err = CreateEncryptedZipArchive(fileCtx, targetFs, zipFileName, sourceFs, file, run.recipients, digest, logger)
+	cancel()
+	if err != nil {
+		logger.Err(err).Msgf("error creating archive %s", DescribeLocation(targetFs, zipFileName))
+		// do not leave a truncated archive behind
+		if removeErr := targetFs.Remove(zipFileName); removeErr != nil && !os.IsNotExist(removeErr) {
+			logger.Warn().Err(removeErr).Msgf("unable to remove incomplete archive %s", DescribeLocation(targetFs, zipFileName))
+		}
+		report.AddFailure(job.JobId, file, "archive", err, fileInfo.Size(), 0, start)
+		return
+	}
+
+	var archiveSize int64
+	if archiveInfo, err := targetFs.Stat(zipFileName); err == nil {
+		archiveSize = archiveInfo.Size()
+	}
+
+	// the original is handled before the manifest is written so its line tells what became of the file
+	original, failedStep := models.ManifestOriginalKept, ""
+	switch job.OriginalFile {
+	case models.OriginalFileDelete:
+		logger.Info().Msgf("deleting original file %s", filepath.Base(file))
+		if err = sourceFs.Remove(file); err != nil {
+			logger.Err(err).Msgf("unable to delete file %s after archive", file)
+			failedStep, err = "delete", fmt.Errorf("archived but not deleted: %w", err)
+		} else {
+			original = models.ManifestOriginalDeleted
+		}
+	case models.OriginalFileTruncate:
+		logger.Info().Msgf("truncating original file %s", filepath.Base(file))
+		if err = truncateFile(sourceFs, file, fileInfo.Size(), logger); err != nil {
+			logger.Err(err).Msgf("unable to truncate file %s after archive", file)
+			failedStep, err = "truncate", fmt.Errorf("archived but not truncated: %w", err)
+		} else {
+			original = models.ManifestOriginalTruncated
+		}
+	}
+
+	entry := models.ManifestEntry{
+		SourcePath:  SourceLocation(sourceFs, file),
+		Size:        digest.Size(),
+		ModTime:     fileInfo.ModTime(),
+		FileDate:    fileDate,
+		SHA256:      digest.Sum(),
+		Archive:     filepath.Base(zipFileName),
+		Folder:      folder,
+		ArchiveSize: archiveSize,
+		Encrypted:   len(run.recipients) > 0,
+		JobId:       job.JobId,
+		Host:        run.host,
+		ArchivedAt:  time.Now(),
+		Original:    original,
+	}
+	manifestErr := AppendManifest(targetFs, backupPath, entry)
+	if manifestErr != nil {
+		logger.Err(manifestErr).Msgf("unable to record %s in the manifest", file)
+	}
+	// the index can be rebuilt from the manifests, so a failure here does not fail the file
+	if err := AppendArchiveIndex(targetFs, run.targetRoot, entry); err != nil {
+		logger.Warn().Err(err).Msgf("unable to add %s to the archive index, run a SEARCH with SEARCH_REBUILD_INDEX=true", file)
+	}
+	if failedStep != "" {
+		report.AddFailure(job.JobId, file, failedStep, err, fileInfo.Size(), archiveSize, start)
+		return
+	}
+	if manifestErr != nil {
+		report.AddFailure(job.JobId, file, "manifest", fmt.Errorf("archived but not recorded in the manifest: %w", manifestErr), fileInfo.Size(), archiveSize, start)
+		return
+	}
+
+	logger.Info().Msgf("Log file %s archived to %s", file, DescribeLocation(targetFs, zipFileName))
+	report.AddFile(job.JobId, file, models.FileStatusArchived, nil, fileInfo.Size(), archiveSize, start)
+}
+
+// archivedUnchanged finds the archive of the file the manifest of the backup folder lists with the same content,
+// the archive being still there. The file is only hashed when an entry of the same source and size is found.
+func (run *archiveJobRun) archivedUnchanged(backupPath, file string, fileInfo os.FileInfo, logger zerolog.Logger) (string, bool) {
+	entries, err := ReadManifest(run.targetFs, backupPath)
+	if err != nil {
+		logger.Warn().Err(err).Msgf("unable to check whether %s is archived already, archiving it", file)
+		return "", false
+	}
+	source := SourceLocation(run.sourceFs, file)
+	checksum := ""
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.SourcePath != source || entry.Size != fileInfo.Size() {
+			continue
+		}
+		if exists, _ := afero.Exists(run.targetFs, filepath.Join(backupPath, entry.Archive)); !exists {
+			continue
+		}
+		if checksum == "" {
+			if checksum, _, err = FileChecksum(run.sourceFs, file); err != nil {
+				logger.Warn().Err(err).Msgf("unable to check whether %s is archived already, archiving it", file)
+				return "", false
 			}
 		}
+		if entry.SHA256 == checksum {
+			return entry.Archive, true
+		}
+	}
+	return "", false
+}
 
-		logger.Info().Msgf("Log file %s archived to %s", file, zipFileName)
+// truncateFile empties a live file in place, like logrotate's copytruncate.
+// Lines written between the copy and the truncate are lost, the writer keeps its file and descriptor.
+func truncateFile(fs afero.Fs, path string, archivedSize int64, logger zerolog.Logger) error {
+	file, err := fs.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if info, err := file.Stat(); err == nil && info.Size() > archivedSize {
+		logger.Warn().Msgf("%s grew by %d bytes while archiving, what was written after the copy is lost", path, info.Size()-archivedSize)
+	}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return err
 	}
+	return file.Close()
 }
 
 // Utility function to check if a file exists
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"CSEFileManager/internal/testfs"
+	"CSEFileManager/models"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// useMemFs runs the test on an in memory local filesystem
+func useMemFs(t *testing.T, fs afero.Fs) {
+	previous := LocalFs
+	LocalFs = fs
+	t.Cleanup(func() { LocalFs = previous })
+}
+
+func archiveTestJob(originalFile string) models.ArchiveJob {
+	return models.ArchiveJob{
+		JobId:                1,
+		ArchiveFromPath:      "/src",
+		ArchiveToPath:        "/dst",
+		FilePattern:          "*.log",
+		FilePatternSeparator: "+",
+		OriginalFile:         originalFile,
+		FolderLayout:         DefaultFolderLayout,
+		DateSource:           models.DateSourceModTime,
+		OnCollision:          models.OnCollisionVersion,
+	}
+}
+
+func runArchiveJob(t *testing.T, job models.ArchiveJob) *models.RunReport {
+	t.Helper()
+	viper.Set("ARCHIVE_JOB_MAX_ROUTINES", 2)
+	t.Cleanup(func() { viper.Set("ARCHIVE_JOB_MAX_ROUTINES", nil) })
+	report := models.NewRunReport("ARCHIVE")
+	WalkDirectoryAndProcessFiles(context.Background(), []models.ArchiveJob{job}, report)
+	report.Finish()
+	return report
+}
+
+func writeSourceFile(t *testing.T, fs afero.Fs, name, content string) {
+	t.Helper()
+	if err := afero.WriteFile(fs, name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 3, 5, 10, 0, 0, 0, time.Local)
+	if err := fs.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveFileZipsAndRecordsFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	useMemFs(t, fs)
+	content := strings.Repeat("log line\n", 1000)
+	writeSourceFile(t, fs, "/src/app.log", content)
+
+	report := runArchiveJob(t, archiveTestJob(models.OriginalFileDelete))
+
+	if report.Counts[models.FileStatusArchived] != 1 {
+		t.Fatalf("counts %v, want 1 archived", report.Counts)
+	}
+	archive, err := afero.ReadFile(fs, "/dst/2024/03/05/app.log.zip")
+	if err != nil {
+		t.Fatalf("archive not written: %v", err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zipReader.File) != 1 || zipReader.File[0].Name != "app.log" || zipReader.File[0].Comment != "/src/app.log" {
+		t.Fatalf("unexpected zip entries %+v", zipReader.File)
+	}
+	entry, err := zipReader.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived, _ := io.ReadAll(entry)
+	if string(archived) != content {
+		t.Fatal("archived content differs from the source")
+	}
+	if exists, _ := afero.Exists(fs, "/src/app.log"); exists {
+		t.Fatal("original not deleted")
+	}
+
+	entries, err := ReadManifest(fs, "/dst/2024/03/05")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("manifest entries %v, %v", entries, err)
+	}
+	checksum := sha256.Sum256([]byte(content))
+	if entries[0].SHA256 != hex.EncodeToString(checksum[:]) || entries[0].Size != int64(len(content)) || entries[0].Original != models.ManifestOriginalDeleted {
+		t.Fatalf("unexpected manifest entry %+v", entries[0])
+	}
+}
+
+func TestArchiveFileRemovesPartialArchive(t *testing.T) {
+	mem := afero.NewMemMapFs()
+	useMemFs(t, testfs.FailingFs{Fs: mem, Suffix: ".zip", Limit: 20})
+	writeSourceFile(t, mem, "/src/app.log", strings.Repeat("log line\n", 1000))
+
+	report := runArchiveJob(t, archiveTestJob(models.OriginalFileDelete))
+
+	if report.Counts[models.FileStatusFailed] != 1 {
+		t.Fatalf("counts %v, want 1 failed", report.Counts)
+	}
+	if result := report.Jobs[0].Files[0]; result.Reason != "archive" || !strings.Contains(result.Error, testfs.ErrDiskFull.Error()) {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if exists, _ := afero.Exists(mem, "/dst/2024/03/05/app.log.zip"); exists {
+		t.Fatal("partial archive left behind")
+	}
+	if exists, _ := afero.Exists(mem, "/src/app.log"); !exists {
+		t.Fatal("original deleted although archiving failed")
+	}
+	if entries, _ := ReadManifest(mem, "/dst/2024/03/05"); len(entries) != 0 {
+		t.Fatalf("failed archive recorded in the manifest: %v", entries)
+	}
+}
+
+func TestArchiveFileSkipsKeptFileArchivedUnchanged(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	useMemFs(t, fs)
+	writeSourceFile(t, fs, "/src/app.log", "first\n")
+	job := archiveTestJob(models.OriginalFileKeep)
+
+	runArchiveJob(t, job)
+	report := runArchiveJob(t, job)
+	if report.Counts[models.FileStatusSkippedProcessed] != 1 {
+		t.Fatalf("counts %v, want the unchanged file skipped", report.Counts)
+	}
+
+	writeSourceFile(t, fs, "/src/app.log", "first\nsecond\n")
+	report = runArchiveJob(t, job)
+	if report.Counts[models.FileStatusArchived] != 1 {
+		t.Fatalf("counts %v, want the changed file archived", report.Counts)
+	}
+	for _, archive := range []string{"app.log.zip", "app.log.1.zip"} {
+		if exists, _ := afero.Exists(fs, filepath.Join("/dst/2024/03/05", archive)); !exists {
+			t.Fatalf("%s missing", archive)
+		}
+	}
+	if exists, _ := afero.Exists(fs, "/dst/2024/03/05/app.log.2.zip"); exists {
+		t.Fatal("unchanged file archived again")
+	}
+}
@@ -1,31 +1,92 @@
 package utils
 
 import (
+	"fmt"
 	"github.com/rs/zerolog"
+	"github.com/spf13/afero"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 )
 
-func CreateBackupFolder(rootFolder string, lastModDate string, logger zerolog.Logger) (string, error) {
-	var year, month, day string
-	dateArray := strings.Split(lastModDate, "-")
-
-	if len(dateArray) == 3 {
-		year = dateArray[0]
-		month = dateArray[1]
-		day = dateArray[2]
-	} else {
-		currentTime := time.Now()
-		year = currentTime.Format("2006")
-		month = currentTime.Format("01")
-		day = currentTime.Format("02")
+// DefaultFolderLayout is the root/YYYY/MM/DD layout archives always had
+const DefaultFolderLayout = "{yyyy}/{mm}/{dd}"
+
+// layoutTokenPattern takes in any braced name, so a mistyped token like {YYYY} is rejected rather than kept as is
+var layoutTokenPattern = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// layoutDateTokens render the date of the file, week and isoyear follow ISO 8601 so {isoyear}-W{week} is safe around new year
+var layoutDateTokens = map[string]func(time.Time) string{
+	"yyyy": func(t time.Time) string { return t.Format("2006") },
+	"yy":   func(t time.Time) string { return t.Format("06") },
+	"mm":   func(t time.Time) string { return t.Format("01") },
+	"dd":   func(t time.Time) string { return t.Format("02") },
+	"week": func(t time.Time) string { _, week := t.ISOWeek(); return fmt.Sprintf("%02d", week) },
+	"isoyear": func(t time.Time) string {
+		year, _ := t.ISOWeek()
+		return fmt.Sprintf("%04d", year)
+	},
+}
+
+// BackupFolderVars are the values of the layout tokens that do not come from the date
+type BackupFolderVars struct {
+	Host         string // {host}
+	Job          string // {job}
+	SourceSubdir string // {source_subdir}, folder of the file below the job source
+}
+
+func (v BackupFolderVars) lookup(token string) (string, bool) {
+	switch token {
+	case "host":
+		return v.Host, true
+	case "job":
+		return v.Job, true
+	case "source_subdir":
+		return v.SourceSubdir, true
+	}
+	return "", false
+}
+
+// ValidateFolderLayout rejects unknown tokens and layouts climbing out of the archive root
+func ValidateFolderLayout(layout string) error {
+	for _, match := range layoutTokenPattern.FindAllStringSubmatch(layout, -1) {
+		if _, ok := layoutDateTokens[match[1]]; ok {
+			continue
+		}
+		if _, ok := (BackupFolderVars{}).lookup(match[1]); !ok {
+			return fmt.Errorf("unknown token %s in folder layout %s", match[0], layout)
+		}
 	}
+	if filepath.IsAbs(layout) || strings.HasPrefix(filepath.Clean(layout), "..") {
+		return fmt.Errorf("folder layout %s must stay below the archive root", layout)
+	}
+	return nil
+}
+
+// RenderFolderLayout fills the layout tokens, an empty layout is DefaultFolderLayout.
+// Tokens rendering empty, like the {source_subdir} of a file right in the job source, leave no empty folder.
+func RenderFolderLayout(layout string, date time.Time, vars BackupFolderVars) string {
+	if layout == "" {
+		layout = DefaultFolderLayout
+	}
+	folder := layoutTokenPattern.ReplaceAllStringFunc(layout, func(token string) string {
+		name := token[1 : len(token)-1]
+		if render, ok := layoutDateTokens[name]; ok {
+			return render(date)
+		}
+		value, _ := vars.lookup(name)
+		return value
+	})
+	return strings.TrimLeft(filepath.Clean(folder), string(filepath.Separator))
+}
 
-	backupFolder := filepath.Join(rootFolder, year, month, day)
+// CreateBackupFolder creates the folder below the root, folder being a rendered layout
+func CreateBackupFolder(fs afero.Fs, rootFolder string, folder string, logger zerolog.Logger) (string, error) {
+	backupFolder := filepath.Join(rootFolder, folder)
 	logger.Info().Msgf("attempting to create backup folder %s", backupFolder)
-	err := os.MkdirAll(backupFolder, os.ModePerm)
+	err := fs.MkdirAll(backupFolder, os.ModePerm)
 	if err != nil {
 		logger.Err(err).Msgf("unable to create backup folder %s", backupFolder)
 		return "", err
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateFolderLayout(t *testing.T) {
+	for _, layout := range []string{"", DefaultFolderLayout, "{isoyear}/{week}", "{host}/{isoyear}-W{week}", "archive/{job}/{source_subdir}/{yy}{mm}"} {
+		if err := ValidateFolderLayout(layout); err != nil {
+			t.Errorf("ValidateFolderLayout(%q) = %v", layout, err)
+		}
+	}
+	for _, layout := range []string{"{year}/{mm}", "{YYYY}", "/archive/{yyyy}", "../{yyyy}", "{yyyy}/../../other"} {
+		if err := ValidateFolderLayout(layout); err == nil {
+			t.Errorf("ValidateFolderLayout(%q) accepted", layout)
+		}
+	}
+}
+
+func TestRenderFolderLayout(t *testing.T) {
+	vars := BackupFolderVars{Host: "host1", Job: "job_1", SourceSubdir: "app/server"}
+	march5 := time.Date(2024, 3, 5, 10, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		layout string
+		date   time.Time
+		want   string
+	}{
+		{"", march5, "2024/03/05"},
+		{DefaultFolderLayout, march5, "2024/03/05"},
+		{"{yy}-{mm}", march5, "24-03"},
+		{"{host}/{job}/{source_subdir}/{dd}", march5, "host1/job_1/app/server/05"},
+		{"{isoyear}/{week}", march5, "2024/10"},
+		// Monday 30 December 2024 is in the first week of 2025
+		{"{isoyear}{week}", time.Date(2024, 12, 30, 0, 0, 0, 0, time.Local), "202501"},
+		{"{yyyy}{week}", time.Date(2024, 12, 30, 0, 0, 0, 0, time.Local), "202401"},
+		// Friday 1 January 2021 is in the last week of 2020
+		{"{isoyear}-W{week}", time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local), "2020-W53"},
+		{"{isoyear}-W{week}", time.Date(2021, 1, 4, 0, 0, 0, 0, time.Local), "2021-W01"},
+	} {
+		if got := RenderFolderLayout(test.layout, test.date, vars); got != test.want {
+			t.Errorf("RenderFolderLayout(%q, %s) = %s, want %s", test.layout, test.date.Format("2006-01-02"), got, test.want)
+		}
+	}
+
+	// a file right in the job source has no subdir
+	if got := RenderFolderLayout("{source_subdir}/{dd}", march5, BackupFolderVars{}); got != "05" {
+		t.Errorf("empty source_subdir rendered as %s", got)
+	}
+}
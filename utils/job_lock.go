@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	lockPollInterval = time.Second
+	// lockRefreshInterval is how often a held lock records that its holder is still running,
+	// more often when LOCK_STALE_AFTER is short
+	lockRefreshInterval = time.Minute
+)
+
+// ErrJobLocked is returned when another process holds the lock of a job past the wait time
+var ErrJobLocked = errors.New("job is locked by another process")
+
+// errLockHeld is what the platform flock returns when the lock is taken
+var errLockHeld = errors.New("lock held")
+
+// JobLock keeps one process at a time on a job, it is an flock on <LOCK_DIR>/<type>_<id>.lock.
+// The holder refreshes the lock while it runs, watchers and daemons hold it for as long as they live.
+type JobLock struct {
+	file *os.File
+	path string
+	info lockInfo
+	stop chan struct{}
+	done chan struct{}
+}
+
+// lockInfo is written into the lock file so other processes can tell who holds it, since when,
+// and whether it still runs
+type lockInfo struct {
+	Pid       int       `json:"pid"`
+	Host      string    `json:"host"`
+	Started   time.Time `json:"started"`
+	Refreshed time.Time `json:"refreshed,omitempty"`
+}
+
+// lastSeen is when the holder last showed it was running, locks written before refreshes existed only have Started
+func (i lockInfo) lastSeen() time.Time {
+	if i.Refreshed.After(i.Started) {
+		return i.Refreshed
+	}
+	return i.Started
+}
+
+func (i lockInfo) String() string {
+	return fmt.Sprintf("pid %d on %s since %s", i.Pid, i.Host, i.Started.Format(time.RFC3339))
+}
+
+func lockDir() string {
+	if dir := viper.GetString("LOCK_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "cse-file-manager")
+}
+
+// LockDurations reads LOCK_WAIT and LOCK_STALE_AFTER, durations like 10m, 12h or 7d, empty being zero
+func LockDurations() (wait, staleAfter time.Duration, err error) {
+	durations := make([]time.Duration, 2)
+	for i, key := range []string{"LOCK_WAIT", "LOCK_STALE_AFTER"} {
+		value := viper.GetString(key)
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		if durations[i], err = ParseDuration(value); err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", key, err)
+		}
+		if durations[i] < 0 {
+			return 0, 0, fmt.Errorf("%s must not be negative, got %s", key, value)
+		}
+	}
+	return durations[0], durations[1], nil
+}
+
+// AcquireJobLock takes the lock of the job, retrying for up to LOCK_WAIT. A lock whose holder is gone,
+// or that was not refreshed for LOCK_STALE_AFTER, is broken. Returns ErrJobLocked when the job stays locked.
+func AcquireJobLock(ctx context.Context, jobType string, jobId int) (*JobLock, error) {
+	wait, staleAfter, err := LockDurations()
+	if err != nil {
+		return nil, err
+	}
+	dir := lockDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s_%d.lock", strings.ToLower(jobType), jobId))
+
+	deadline := time.Now().Add(wait)
+	waiting := false
+	for {
+		lock, holder, err := tryJobLock(path, staleAfter)
+		if err != nil {
+			return nil, err
+		}
+		if lock != nil {
+			log.Debug().Msgf("acquired lock %s", path)
+			return lock, nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%w: %s", ErrJobLocked, holder)
+		}
+		if !waiting {
+			log.Info().Msgf("%s job %d is locked by %s, waiting up to %s", jobType, jobId, holder, wait)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// tryJobLock makes one attempt, a nil lock with no error means the lock is held by the returned holder
+func tryJobLock(path string, staleAfter time.Duration) (*JobLock, lockInfo, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, lockInfo{}, fmt.Errorf("failed to open lock file %s: %w", path, err)
+		}
+
+		if err := flockFile(file); err != nil {
+			holder := readLockInfo(file)
+			file.Close()
+			if !errors.Is(err, errLockHeld) {
+				return nil, holder, fmt.Errorf("failed to lock %s: %w", path, err)
+			}
+			reason := staleLockReason(holder, staleAfter)
+			if reason == "" {
+				return nil, holder, nil
+			}
+			// unlinking gives the next open a fresh file, the stale holder keeps its lock on the old one
+			log.Warn().Msgf("breaking stale lock %s held by %s: %s", path, holder, reason)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, holder, fmt.Errorf("failed to remove stale lock %s: %w", path, err)
+			}
+			continue
+		}
+
+		// the file may have been unlinked by a releasing or stale-breaking process while we waited on it
+		pathInfo, pathErr := os.Stat(path)
+		fileInfo, fileErr := file.Stat()
+		if pathErr != nil || fileErr != nil || !os.SameFile(pathInfo, fileInfo) {
+			file.Close()
+			continue
+		}
+
+		host, _ := os.Hostname()
+		lock := &JobLock{file: file, path: path, info: lockInfo{Pid: os.Getpid(), Host: host, Started: time.Now()},
+			stop: make(chan struct{}), done: make(chan struct{})}
+		if err := lock.writeInfo(); err != nil {
+			log.Warn().Err(err).Msgf("unable to record the holder in lock file %s", path)
+		}
+		go lock.refresh(refreshInterval(staleAfter))
+		return lock, lockInfo{}, nil
+	}
+}
+
+// refreshInterval keeps a few refreshes within the stale time, so a live holder is never taken for a stale one
+func refreshInterval(staleAfter time.Duration) time.Duration {
+	if staleAfter > 0 && staleAfter/3 < lockRefreshInterval {
+		return staleAfter / 3
+	}
+	return lockRefreshInterval
+}
+
+// refresh records the time in the lock file every interval until the lock is released
+func (l *JobLock) refresh(interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			l.info.Refreshed = now
+			if err := l.writeInfo(); err != nil {
+				log.Warn().Err(err).Msgf("unable to refresh lock file %s", l.path)
+			}
+		}
+	}
+}
+
+func (l *JobLock) writeInfo() error {
+	info, _ := json.Marshal(l.info)
+	if _, err := l.file.WriteAt(info, 0); err != nil {
+		return err
+	}
+	return l.file.Truncate(int64(len(info)))
+}
+
+func readLockInfo(file *os.File) lockInfo {
+	var info lockInfo
+	content, err := io.ReadAll(io.NewSectionReader(file, 0, 4096))
+	if err == nil {
+		json.Unmarshal(content, &info)
+	}
+	return info
+}
+
+// staleLockReason tells why a held lock can be broken, an empty reason means it is live
+func staleLockReason(holder lockInfo, staleAfter time.Duration) string {
+	host, _ := os.Hostname()
+	if holder.Pid > 0 && holder.Host == host && !processAlive(holder.Pid) {
+		return fmt.Sprintf("process %d is gone", holder.Pid)
+	}
+	if staleAfter > 0 && !holder.lastSeen().IsZero() && time.Since(holder.lastSeen()) > staleAfter {
+		return fmt.Sprintf("not refreshed for more than %s", staleAfter)
+	}
+	return ""
+}
+
+// Release removes the lock file then drops the lock, waiting processes retry on a fresh file
+func (l *JobLock) Release() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	// a lock broken as stale has been replaced by another process's file, leave that one alone
+	pathInfo, pathErr := os.Stat(l.path)
+	fileInfo, fileErr := l.file.Stat()
+	if pathErr == nil && fileErr == nil && os.SameFile(pathInfo, fileInfo) {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Msgf("unable to remove lock file %s", l.path)
+		}
+	}
+	l.file.Close()
+	log.Debug().Msgf("released lock %s", l.path)
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package utils
+
+import "os"
+
+// flockFile has no advisory lock to take here, only the pid and age in the lock file are checked
+func flockFile(file *os.File) error {
+	if info := readLockInfo(file); info.Pid > 0 && info.Pid != os.Getpid() {
+		return errLockHeld
+	}
+	return nil
+}
+
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
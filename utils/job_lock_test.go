@@ -0,0 +1,176 @@
+//go:build unix
+
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockDurations(t *testing.T) {
+	for _, test := range []struct {
+		wait, staleAfter         string
+		wantWait, wantStaleAfter time.Duration
+		fails                    bool
+	}{
+		{"", "", 0, 0, false},
+		{"10m", "12h", 10 * time.Minute, 12 * time.Hour, false},
+		{"1d", "2w", 24 * time.Hour, 14 * 24 * time.Hour, false},
+		{" 90s ", "1d12h", 90 * time.Second, 36 * time.Hour, false},
+		{"soon", "", 0, 0, true},
+		{"", "7days", 0, 0, true},
+		{"-1m", "", 0, 0, true},
+	} {
+		withSettings(t, map[string]any{"LOCK_WAIT": test.wait, "LOCK_STALE_AFTER": test.staleAfter})
+		wait, staleAfter, err := LockDurations()
+		if (err != nil) != test.fails || wait != test.wantWait || staleAfter != test.wantStaleAfter {
+			t.Errorf("LOCK_WAIT=%q LOCK_STALE_AFTER=%q gave %s, %s, %v", test.wait, test.staleAfter, wait, staleAfter, err)
+		}
+	}
+}
+
+// holdLockFile takes the lock of FUPM job 1 like another process would, recording the holder given
+func holdLockFile(t *testing.T, holder lockInfo) {
+	t.Helper()
+	file, err := os.OpenFile(filepath.Join(lockDir(), "fupm_1.lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	if err := flockFile(file); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := json.Marshal(holder)
+	if _, err := file.Write(info); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deadPid is the pid of a process that has exited
+func deadPid(t *testing.T) int {
+	t.Helper()
+	command := exec.Command("true")
+	if err := command.Run(); err != nil {
+		t.Skipf("unable to run a process: %v", err)
+	}
+	return command.Process.Pid
+}
+
+func TestAcquireJobLock(t *testing.T) {
+	withSettings(t, map[string]any{"LOCK_DIR": t.TempDir(), "LOCK_WAIT": "", "LOCK_STALE_AFTER": ""})
+	lock, err := AcquireJobLock(context.Background(), "FUPM", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err := AcquireJobLock(context.Background(), "ARCHIVE", 1); err != nil {
+		t.Fatalf("jobs of another type share the lock: %v", err)
+	} else {
+		other.Release()
+	}
+
+	if _, err := AcquireJobLock(context.Background(), "FUPM", 1); !errors.Is(err, ErrJobLocked) {
+		t.Fatalf("second acquire gave %v, want %v", err, ErrJobLocked)
+	}
+	lock.Release()
+	if _, err := os.Stat(lock.path); !os.IsNotExist(err) {
+		t.Fatalf("lock file left after release: %v", err)
+	}
+	lock, err = AcquireJobLock(context.Background(), "FUPM", 1)
+	if err != nil {
+		t.Fatalf("released lock not taken again: %v", err)
+	}
+	lock.Release()
+}
+
+func TestAcquireJobLockWaitsForRelease(t *testing.T) {
+	withSettings(t, map[string]any{"LOCK_DIR": t.TempDir(), "LOCK_WAIT": "10s", "LOCK_STALE_AFTER": ""})
+	lock, err := AcquireJobLock(context.Background(), "FUPM", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(500*time.Millisecond, lock.Release)
+
+	start := time.Now()
+	waited, err := AcquireJobLock(context.Background(), "FUPM", 1)
+	if err != nil {
+		t.Fatalf("lock released while waiting not taken: %v", err)
+	}
+	waited.Release()
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("took the lock after %s, before it was released", elapsed)
+	}
+
+	// a wait cut short by the context
+	lock, _ = AcquireJobLock(context.Background(), "FUPM", 1)
+	defer lock.Release()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := AcquireJobLock(ctx, "FUPM", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the context error", err)
+	}
+}
+
+func TestAcquireJobLockBreaksLockOfDeadProcess(t *testing.T) {
+	withSettings(t, map[string]any{"LOCK_DIR": t.TempDir(), "LOCK_WAIT": "", "LOCK_STALE_AFTER": ""})
+	host, _ := os.Hostname()
+	holdLockFile(t, lockInfo{Pid: deadPid(t), Host: host, Started: time.Now()})
+
+	lock, err := AcquireJobLock(context.Background(), "FUPM", 1)
+	if err != nil {
+		t.Fatalf("lock of a dead process not broken: %v", err)
+	}
+	lock.Release()
+}
+
+func TestAcquireJobLockKeepsLockOfDeadPidOnAnotherHost(t *testing.T) {
+	withSettings(t, map[string]any{"LOCK_DIR": t.TempDir(), "LOCK_WAIT": "", "LOCK_STALE_AFTER": ""})
+	holdLockFile(t, lockInfo{Pid: deadPid(t), Host: "another-host", Started: time.Now()})
+
+	if _, err := AcquireJobLock(context.Background(), "FUPM", 1); !errors.Is(err, ErrJobLocked) {
+		t.Fatalf("got %v, the pid of another host cannot be checked here", err)
+	}
+}
+
+func TestAcquireJobLockBreaksStaleLock(t *testing.T) {
+	withSettings(t, map[string]any{"LOCK_DIR": t.TempDir(), "LOCK_WAIT": ""})
+	host, _ := os.Hostname()
+	// a live holder that stopped refreshing its lock an hour ago
+	holdLockFile(t, lockInfo{Pid: os.Getpid(), Host: host, Started: time.Now().Add(-2 * time.Hour), Refreshed: time.Now().Add(-time.Hour)})
+
+	withSettings(t, map[string]any{"LOCK_STALE_AFTER": "2h"})
+	if _, err := AcquireJobLock(context.Background(), "FUPM", 1); !errors.Is(err, ErrJobLocked) {
+		t.Fatalf("got %v, the lock was refreshed within LOCK_STALE_AFTER", err)
+	}
+	withSettings(t, map[string]any{"LOCK_STALE_AFTER": "30m"})
+	lock, err := AcquireJobLock(context.Background(), "FUPM", 1)
+	if err != nil {
+		t.Fatalf("stale lock not broken: %v", err)
+	}
+	lock.Release()
+}
+
+func TestJobLockRefreshKeepsLongHeldLockLive(t *testing.T) {
+	withSettings(t, map[string]any{"LOCK_DIR": t.TempDir(), "LOCK_STALE_AFTER": "300ms"})
+	lock, err := AcquireJobLock(context.Background(), "FUPM", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	// held three times longer than the stale time, like a watcher
+	time.Sleep(900 * time.Millisecond)
+	other, holder, err := tryJobLock(lock.path, 300*time.Millisecond)
+	if err != nil || other != nil {
+		other.Release()
+		t.Fatalf("a refreshed lock was broken as stale: %v", err)
+	}
+	if time.Since(holder.lastSeen()) > 300*time.Millisecond {
+		t.Fatalf("lock last refreshed at %s", holder.lastSeen())
+	}
+}
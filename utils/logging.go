@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// verboseLogging is set by the -verbose flag, it takes every logger down to debug at least
+var verboseLogging atomic.Bool
+
+func SetVerboseLogging(verbose bool) {
+	verboseLogging.Store(verbose)
+}
+
+// ParseLogLevel reads a level: trace, debug, info, warn, error or disabled.
+// Empty gives debug, everything the file manager logs, as before levels could be set: a config file
+// without LOG_LEVEL logs at debug, the settings.env shipped with the file manager sets info.
+func ParseLogLevel(value string) (zerolog.Level, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return zerolog.DebugLevel, nil
+	}
+	level, err := zerolog.ParseLevel(value)
+	if err != nil {
+		return zerolog.NoLevel, fmt.Errorf("unknown log level %q, expected trace, debug, info, warn, error or disabled", value)
+	}
+	return level, nil
+}
+
+// LogLevel is the level set by LOG_LEVEL, lowered to debug by -verbose
+func LogLevel() (zerolog.Level, error) {
+	level, err := ParseLogLevel(viper.GetString("LOG_LEVEL"))
+	if err != nil {
+		return zerolog.NoLevel, fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	return verbosity(level), nil
+}
+
+func verbosity(level zerolog.Level) zerolog.Level {
+	if verboseLogging.Load() && level > zerolog.DebugLevel {
+		return zerolog.DebugLevel
+	}
+	return level
+}
+
+// JobLogger is the logger of one job of a run, its lines carry the job_id and the run_id.
+// The job level, validated along with the job, replaces LOG_LEVEL for them when set.
+func JobLogger(report *models.RunReport, jobId int, level string) zerolog.Logger {
+	logger := log.With().Int("job_id", jobId).Str("run_id", report.RunId).Logger()
+	if jobLevel, err := ParseLogLevel(level); err == nil && level != "" {
+		logger = logger.Level(verbosity(jobLevel))
+	}
+	return logger
+}
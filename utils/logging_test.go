@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func withVerboseLogging(t *testing.T, verbose bool) {
+	SetVerboseLogging(verbose)
+	t.Cleanup(func() { SetVerboseLogging(false) })
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for value, want := range map[string]zerolog.Level{
+		"":         zerolog.DebugLevel,
+		" ":        zerolog.DebugLevel,
+		"trace":    zerolog.TraceLevel,
+		"INFO ":    zerolog.InfoLevel,
+		"warn":     zerolog.WarnLevel,
+		"error":    zerolog.ErrorLevel,
+		"disabled": zerolog.Disabled,
+	} {
+		if got, err := ParseLogLevel(value); err != nil || got != want {
+			t.Errorf("ParseLogLevel(%q) = %s, %v, want %s", value, got, err, want)
+		}
+	}
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
+
+func TestLogLevelVerbose(t *testing.T) {
+	for _, test := range []struct {
+		setting string
+		verbose bool
+		want    zerolog.Level
+	}{
+		{"", false, zerolog.DebugLevel},
+		{"info", false, zerolog.InfoLevel},
+		{"info", true, zerolog.DebugLevel},
+		{"disabled", true, zerolog.DebugLevel},
+		// -verbose only lowers the level, trace stays
+		{"trace", true, zerolog.TraceLevel},
+	} {
+		withSettings(t, map[string]any{"LOG_LEVEL": test.setting})
+		withVerboseLogging(t, test.verbose)
+		if got, err := LogLevel(); err != nil || got != test.want {
+			t.Errorf("LOG_LEVEL=%q verbose=%t gave %s, %v, want %s", test.setting, test.verbose, got, err, test.want)
+		}
+	}
+	withSettings(t, map[string]any{"LOG_LEVEL": "loud"})
+	if _, err := LogLevel(); err == nil || !strings.Contains(err.Error(), "LOG_LEVEL") {
+		t.Errorf("unknown LOG_LEVEL gave %v", err)
+	}
+}
+
+// logLines runs fn with the global logger at level writing to a buffer, and returns the messages logged
+func logLines(t *testing.T, level zerolog.Level, fn func()) string {
+	t.Helper()
+	var out bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&out).Level(level)
+	t.Cleanup(func() { log.Logger = previous })
+	fn()
+	return out.String()
+}
+
+func TestJobLoggerLevel(t *testing.T) {
+	report := models.NewRunReport("ARCHIVE")
+	for _, test := range []struct {
+		global   zerolog.Level
+		jobLevel string
+		verbose  bool
+		want     []string // the levels of the lines written
+	}{
+		{zerolog.InfoLevel, "", false, []string{"info", "warn"}},
+		{zerolog.InfoLevel, "warn", false, []string{"warn"}},
+		{zerolog.InfoLevel, "debug", false, []string{"debug", "info", "warn"}},
+		{zerolog.WarnLevel, "debug", false, []string{"debug", "info", "warn"}},
+		{zerolog.InfoLevel, "disabled", false, nil},
+		// -verbose takes job levels down to debug as well
+		{zerolog.DebugLevel, "warn", true, []string{"debug", "info", "warn"}},
+		// an invalid job level is rejected with the job, the logger keeps the global level
+		{zerolog.InfoLevel, "loud", false, []string{"info", "warn"}},
+	} {
+		withVerboseLogging(t, test.verbose)
+		output := logLines(t, test.global, func() {
+			logger := JobLogger(report, 3, test.jobLevel)
+			logger.Debug().Msg("debug")
+			logger.Info().Msg("info")
+			logger.Warn().Msg("warn")
+		})
+		var levels []string
+		for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+			if line == "" {
+				continue
+			}
+			if !strings.Contains(line, `"job_id":3`) || !strings.Contains(line, `"run_id":"`+report.RunId+`"`) {
+				t.Errorf("line without the job and run ids: %s", line)
+			}
+			for _, level := range []string{"debug", "info", "warn"} {
+				if strings.Contains(line, `"level":"`+level+`"`) {
+					levels = append(levels, level)
+				}
+			}
+		}
+		if strings.Join(levels, ",") != strings.Join(test.want, ",") {
+			t.Errorf("global %s, job level %q, verbose %t: wrote %v, want %v", test.global, test.jobLevel, test.verbose, levels, test.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/afero"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ManifestFileName is the JSON lines manifest kept in every backup folder
+const ManifestFileName = "manifest.jsonl"
+
+// jsonLinesPartsSuffix names the folder holding the lines appended to a JSON lines file on object storage.
+// Objects cannot be appended to, so every line is an object of its own, <file>.d/<time>-<random>.json,
+// and readers take the parts after the file. Hosts writing to the same bucket never overwrite each other's lines.
+const jsonLinesPartsSuffix = ".d"
+
+// AppendManifest adds the entry to the manifest of the backup folder
+func AppendManifest(fs afero.Fs, folder string, entry models.ManifestEntry) error {
+	return appendJSONLine(fs, filepath.Join(folder, ManifestFileName), entry)
+}
+
+// ReadManifest reads the entries of the manifest of the backup folder, none when the folder has no manifest yet.
+// Lines that do not parse are left out.
+func ReadManifest(fs afero.Fs, folder string) ([]models.ManifestEntry, error) {
+	path := filepath.Join(folder, ManifestFileName)
+	reader, err := openJSONLines(fs, path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", DescribeLocation(fs, path), err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", DescribeLocation(fs, path), err)
+	}
+	var entries []models.ManifestEntry
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		var entry models.ManifestEntry
+		if len(bytes.TrimSpace(line)) > 0 && json.Unmarshal(line, &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// appendJSONLine adds one line to a JSON lines file. Locally the line goes out in a single O_APPEND write,
+// so lines of concurrent writers never interleave. On object storage the line is written as a part of the file.
+func appendJSONLine(fs afero.Fs, path string, value any) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, ok := fs.(S3Fs); ok {
+		return writeJSONLinePart(fs, path, line)
+	}
+
+	file, err := fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to append to %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+// writeJSONLinePart writes the line as a part of the file, named after the time so parts read back in write order
+func writeJSONLinePart(fs afero.Fs, path string, line []byte) error {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	part := filepath.Join(path+jsonLinesPartsSuffix, fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), hex.EncodeToString(suffix)))
+	if err := afero.WriteFile(fs, part, line, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", DescribeLocation(fs, part), err)
+	}
+	return nil
+}
+
+// jsonLinesParts lists the parts of a JSON lines file in the order they were written
+func jsonLinesParts(fs afero.Fs, path string) ([]string, error) {
+	dir := path + jsonLinesPartsSuffix
+	infos, err := afero.ReadDir(fs, dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", DescribeLocation(fs, dir), err)
+	}
+	var parts []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".json") {
+			parts = append(parts, filepath.Join(dir, info.Name()))
+		}
+	}
+	return parts, nil
+}
+
+// openJSONLines reads a JSON lines file followed by its parts. The error wraps os.ErrNotExist when there is neither.
+func openJSONLines(fs afero.Fs, path string) (io.ReadCloser, error) {
+	parts, err := jsonLinesParts(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	var readers []io.Reader
+	var closer io.Closer = io.NopCloser(nil)
+	file, err := fs.Open(path)
+	switch {
+	case err == nil:
+		readers, closer = append(readers, file), file
+	case !os.IsNotExist(err) || len(parts) == 0:
+		return nil, err
+	}
+
+	var appended bytes.Buffer
+	for _, part := range parts {
+		line, err := afero.ReadFile(fs, part)
+		if os.IsNotExist(err) {
+			// removed by an index rebuild since it was listed, its line is in the file now
+			continue
+		}
+		if err != nil {
+			closer.Close()
+			return nil, fmt.Errorf("failed to read %s: %w", DescribeLocation(fs, part), err)
+		}
+		appended.Write(line)
+	}
+	readers = append(readers, &appended)
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(readers...), closer}, nil
+}
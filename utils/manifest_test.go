@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// appendPart appends the entry the way it is appended on object storage
+func appendPart(t *testing.T, fs afero.Fs, path string, entry models.ManifestEntry) {
+	t.Helper()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSONLinePart(fs, path, append(line, '\n')); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func archiveNames(entries []models.ManifestEntry) []string {
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Archive)
+	}
+	return names
+}
+
+func TestReadManifestMergesParts(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := AppendManifest(fs, "/dst/a", models.ManifestEntry{Archive: "1.zip"}); err != nil {
+		t.Fatal(err)
+	}
+	appendPart(t, fs, "/dst/a/"+ManifestFileName, models.ManifestEntry{Archive: "2.zip"})
+	appendPart(t, fs, "/dst/a/"+ManifestFileName, models.ManifestEntry{Archive: "3.zip"})
+	appendPart(t, fs, "/dst/b/"+ManifestFileName, models.ManifestEntry{Archive: "4.zip"})
+
+	entries, err := ReadManifest(fs, "/dst/a")
+	if got := archiveNames(entries); err != nil || len(got) != 3 || got[0] != "1.zip" || got[1] != "2.zip" || got[2] != "3.zip" {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	entries, err = ReadManifest(fs, "/dst/b")
+	if got := archiveNames(entries); err != nil || len(got) != 1 || got[0] != "4.zip" {
+		t.Fatalf("manifest with parts only gave %v, %v", got, err)
+	}
+	if entries, err := ReadManifest(fs, "/dst/c"); err != nil || len(entries) != 0 {
+		t.Fatalf("folder without manifest gave %v, %v", entries, err)
+	}
+}
+
+func TestReadArchiveIndexMergesParts(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	read := func() ([]string, error) {
+		var names []string
+		err := ReadArchiveIndex(context.Background(), fs, "/dst", func(entry models.ManifestEntry) bool {
+			names = append(names, entry.Archive)
+			return true
+		})
+		return names, err
+	}
+
+	if _, err := read(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing index gave %v, want os.ErrNotExist", err)
+	}
+	appendPart(t, fs, "/dst/"+ArchiveIndexFileName, models.ManifestEntry{Archive: "1.zip"})
+	if got, err := read(); err != nil || len(got) != 1 {
+		t.Fatalf("index with parts only gave %v, %v", got, err)
+	}
+	if err := AppendArchiveIndex(fs, "/dst", models.ManifestEntry{Archive: "0.zip"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read(); err != nil || len(got) != 2 || got[0] != "0.zip" || got[1] != "1.zip" {
+		t.Fatalf("got %v, %v", got, err)
+	}
+}
+
+func TestRebuildArchiveIndexFoldsParts(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	index := filepath.Join("/dst", ArchiveIndexFileName)
+	if err := AppendManifest(fs, "/dst/2024/03/05", models.ManifestEntry{Archive: "a.log.zip"}); err != nil {
+		t.Fatal(err)
+	}
+	// a folder written by another host, and the index lines of both
+	appendPart(t, fs, "/dst/2024/03/06/"+ManifestFileName, models.ManifestEntry{Archive: "b.log.zip"})
+	appendPart(t, fs, index, models.ManifestEntry{Archive: "a.log.zip"})
+	appendPart(t, fs, index, models.ManifestEntry{Archive: "b.log.zip"})
+
+	count, err := RebuildArchiveIndex(context.Background(), fs, "/dst")
+	if err != nil || count != 2 {
+		t.Fatalf("indexed %d, %v", count, err)
+	}
+	if parts, _ := jsonLinesParts(fs, index); len(parts) != 0 {
+		t.Fatalf("index parts left after the rebuild: %v", parts)
+	}
+	var names []string
+	err = ReadArchiveIndex(context.Background(), fs, "/dst", func(entry models.ManifestEntry) bool {
+		names = append(names, entry.Folder+"/"+entry.Archive)
+		return true
+	})
+	if err != nil || len(names) != 2 || names[0] != "2024/03/05/a.log.zip" || names[1] != "2024/03/06/b.log.zip" {
+		t.Fatalf("index holds %v, %v", names, err)
+	}
+	if entries, _ := ReadManifest(fs, "/dst/2024/03/06"); len(entries) != 1 {
+		t.Fatal("manifest parts were removed by the rebuild")
+	}
+}
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// MetricsRegistry holds only the file manager metrics, no go runtime noise in the textfile
+var MetricsRegistry = prometheus.NewRegistry()
+
+var (
+	filesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cse_files_processed_total",
+		Help: "Files handled per job and outcome (archived, transferred, skipped_*, failed).",
+	}, []string{"job_type", "job_id", "status"})
+
+	fileFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cse_file_failures_total",
+		Help: "Failed files per job and the step that failed.",
+	}, []string{"job_type", "job_id", "reason"})
+
+	jobFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cse_job_failures_total",
+		Help: "Jobs that stopped before handling their files.",
+	}, []string{"job_type", "job_id"})
+
+	bytesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cse_bytes_total",
+		Help: "Bytes read from sources (in) and written to targets (out).",
+	}, []string{"job_type", "job_id", "direction"})
+
+	compressionRatio = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cse_archive_compression_ratio",
+		Help:    "Archive size divided by original size.",
+		Buckets: []float64{0.01, 0.02, 0.05, 0.1, 0.2, 0.3, 0.5, 0.75, 1, 1.5},
+	}, []string{"job_id"})
+
+	fileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cse_file_duration_seconds",
+		Help:    "Time spent on one file, whatever its outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"job_type", "job_id"})
+
+	registryRecords = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cse_registry_records",
+		Help: "Records in the FUPM processed files registry.",
+	})
+
+	dbInsertDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cse_db_insert_duration_seconds",
+		Help:    "Latency of FUPM inserts, connection included.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+
+	lastRunTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cse_last_run_timestamp_seconds",
+		Help: "End of the last run.",
+	}, []string{"job_type"})
+
+	lastRunDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cse_last_run_duration_seconds",
+		Help: "Duration of the last run.",
+	}, []string{"job_type"})
+
+	lastRunExitCode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cse_last_run_exit_code",
+		Help: "Exit code the last run mapped to, 0 is success.",
+	}, []string{"job_type"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(filesProcessed, fileFailures, jobFailures, bytesProcessed, compressionRatio,
+		fileDuration, registryRecords, dbInsertDuration, lastRunTimestamp, lastRunDuration, lastRunExitCode)
+}
+
+// ObserveFileResult is hooked into RunReport.OnFile
+func ObserveFileResult(jobType string, jobId int, result models.FileResult) {
+	id := strconv.Itoa(jobId)
+	filesProcessed.WithLabelValues(jobType, id, result.Status).Inc()
+	if result.Status == models.FileStatusFailed {
+		fileFailures.WithLabelValues(jobType, id, result.Reason).Inc()
+	}
+	// skipped and failed files take time too, a hanging stat or a failed upload shows in the duration
+	fileDuration.WithLabelValues(jobType, id).Observe(result.Duration.Seconds())
+	if result.BytesIn > 0 || result.BytesOut > 0 {
+		bytesProcessed.WithLabelValues(jobType, id, "in").Add(float64(result.BytesIn))
+		bytesProcessed.WithLabelValues(jobType, id, "out").Add(float64(result.BytesOut))
+	}
+	if result.Status == models.FileStatusArchived && result.BytesIn > 0 {
+		compressionRatio.WithLabelValues(id).Observe(float64(result.BytesOut) / float64(result.BytesIn))
+	}
+}
+
+// ObserveRunReport records the run level metrics once the run has finished
+func ObserveRunReport(report *models.RunReport) {
+	for _, job := range report.Jobs {
+		if job.Error != "" {
+			jobFailures.WithLabelValues(report.JobType, strconv.Itoa(job.JobId)).Inc()
+		}
+	}
+	lastRunTimestamp.WithLabelValues(report.JobType).Set(float64(report.EndTime.Unix()))
+	lastRunDuration.WithLabelValues(report.JobType).Set(report.Duration.Seconds())
+	lastRunExitCode.WithLabelValues(report.JobType).Set(float64(report.ExitCode()))
+}
+
+func SetRegistrySize(records int) {
+	registryRecords.Set(float64(records))
+}
+
+func ObserveDbInsert(duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	dbInsertDuration.WithLabelValues(result).Observe(duration.Seconds())
+}
+
+// ServeMetrics exposes /metrics on the given address in the background
+func ServeMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Info().Msgf("serving metrics on %s/metrics", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msgf("metrics endpoint on %s stopped", addr)
+		}
+	}()
+	return server
+}
+
+// WriteMetricsTextfile writes the metrics for the node_exporter textfile collector, the file is replaced atomically
+func WriteMetricsTextfile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return prometheus.WriteToTextfile(path, MetricsRegistry)
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveFileResultTimesEveryOutcome(t *testing.T) {
+	for i, result := range []models.FileResult{
+		{Status: models.FileStatusFailed, Reason: "stat", Duration: 2 * time.Second},
+		{Status: models.FileStatusSkippedAge, Duration: time.Millisecond},
+		{Status: models.FileStatusTransferred, BytesIn: 10, BytesOut: 10, Duration: time.Second},
+	} {
+		series := testutil.CollectAndCount(fileDuration)
+		// a job id of its own, so the observation adds a series
+		ObserveFileResult("FUPM", 9000+i, result)
+		if got := testutil.CollectAndCount(fileDuration); got != series+1 {
+			t.Fatalf("%s file: no duration observed", result.Status)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	EventCompletion    = "completion"
+	EventFailure       = "failure"
+	EventMissingFiles  = "missing_files"
+	EventRegistryError = "registry_error"
+	EventLocked        = "locked"
+
+	defaultNotifyOn       = EventFailure + "," + EventMissingFiles + "," + EventRegistryError
+	defaultNotifyTemplate = `{{.JobType}} job {{.JobId}} on {{.Host}}: {{.Event}}, {{.Succeeded}} ok, {{.Skipped}} skipped, {{.Failed}} failed of {{.FilesMatched}} matched` +
+		`{{if .Error}} - {{.Error}}{{end}}{{range .Failures}}
+- {{.File}} ({{.Reason}}): {{.Error}}{{end}}`
+)
+
+// notifyTimeout bounds every webhook call and email, a server that stops answering does not hold the run
+var notifyTimeout = 10 * time.Second
+
+// NotificationEvent is what templates see and what the json webhook receives
+type NotificationEvent struct {
+	Event        string              `json:"event"`
+	JobType      string              `json:"job_type"`
+	JobId        int                 `json:"job_id"`
+	Host         string              `json:"host"`
+	Time         time.Time           `json:"time"`
+	FilesMatched int                 `json:"files_matched"`
+	Succeeded    int                 `json:"succeeded"`
+	Skipped      int                 `json:"skipped"`
+	Failed       int                 `json:"failed"`
+	Error        string              `json:"error,omitempty"`
+	Failures     []models.FileResult `json:"failures,omitempty"`
+	Message      string              `json:"message"`
+}
+
+// NotifyRunOutcome sends one notification per job and event, templates are keyed by job id
+func NotifyRunOutcome(report *models.RunReport, templates map[int]string) {
+	webhookURL := viper.GetString("NOTIFY_WEBHOOK_URL")
+	smtpHost := viper.GetString("NOTIFY_SMTP_HOST")
+	if webhookURL == "" && smtpHost == "" {
+		return
+	}
+
+	enabled := make(map[string]bool)
+	notifyOn := viper.GetString("NOTIFY_ON")
+	if notifyOn == "" {
+		notifyOn = defaultNotifyOn
+	}
+	for _, event := range strings.Split(notifyOn, ",") {
+		enabled[strings.TrimSpace(event)] = true
+	}
+
+	for _, event := range buildNotificationEvents(report) {
+		if !enabled[event.Event] {
+			continue
+		}
+		message, err := renderNotification(templates[event.JobId], event)
+		if err != nil {
+			log.Error().Err(err).Msgf("invalid notification template for %s job %d, using the default", event.JobType, event.JobId)
+			message, _ = renderNotification("", event)
+		}
+		event.Message = message
+
+		if webhookURL != "" {
+			if err := sendWebhook(webhookURL, viper.GetString("NOTIFY_WEBHOOK_FORMAT"), event); err != nil {
+				log.Error().Err(err).Msgf("unable to send %s webhook for %s job %d", event.Event, event.JobType, event.JobId)
+			}
+		}
+		if smtpHost != "" {
+			if err := sendEmail(smtpHost, event); err != nil {
+				log.Error().Err(err).Msgf("unable to send %s email for %s job %d", event.Event, event.JobType, event.JobId)
+			}
+		}
+	}
+}
+
+func buildNotificationEvents(report *models.RunReport) []NotificationEvent {
+	host, _ := os.Hostname()
+	var events []NotificationEvent
+	for _, job := range report.Jobs {
+		base := NotificationEvent{
+			JobType:      report.JobType,
+			JobId:        job.JobId,
+			Host:         host,
+			Time:         report.EndTime,
+			FilesMatched: job.FilesMatched,
+			Error:        job.Error,
+		}
+		registryError := false
+		for _, file := range job.Files {
+			switch file.Status {
+			case models.FileStatusFailed:
+				base.Failed++
+				base.Failures = append(base.Failures, file)
+				if file.Reason == "registry" || file.Reason == "db_insert" {
+					registryError = true
+				}
+			case models.FileStatusArchived, models.FileStatusTransferred, models.FileStatusRestored:
+				base.Succeeded++
+			default:
+				base.Skipped++
+			}
+		}
+
+		add := func(name string) {
+			event := base
+			event.Event = name
+			events = append(events, event)
+		}
+		switch {
+		case job.LockedBy != "":
+			event := base
+			event.Event, event.Error = EventLocked, job.LockedBy
+			events = append(events, event)
+		case job.Error != "" || base.Failed > 0:
+			add(EventFailure)
+		case job.FilesMatched == 0:
+			add(EventMissingFiles)
+		default:
+			add(EventCompletion)
+		}
+		if registryError {
+			add(EventRegistryError)
+		}
+	}
+	return events
+}
+
+// ValidateNotifyTemplate checks a per job template once, while the configuration is parsed
+func ValidateNotifyTemplate(text string) error {
+	_, err := renderNotification(text, NotificationEvent{})
+	return err
+}
+
+func renderNotification(text string, event NotificationEvent) (string, error) {
+	if text == "" {
+		text = defaultNotifyTemplate
+	}
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, event); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// sendWebhook posts the event as json, or as a Slack or Teams compatible message
+func sendWebhook(url, format string, event NotificationEvent) error {
+	var payload any
+	switch strings.ToLower(format) {
+	case "slack":
+		payload = map[string]string{"text": event.Message}
+	case "teams":
+		payload = map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  fmt.Sprintf("%s job %d %s", event.JobType, event.JobId, event.Event),
+			"text":     strings.ReplaceAll(event.Message, "\n", "<br>"),
+		}
+	default:
+		payload = event
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	// errors may quote connection strings or settings, the payload leaves with the secrets redacted like the logs
+	body = redactSecrets(body)
+	client := &http.Client{Timeout: notifyTimeout}
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", response.Status)
+	}
+	log.Info().Msgf("sent %s webhook for %s job %d", event.Event, event.JobType, event.JobId)
+	return nil
+}
+
+func sendEmail(host string, event NotificationEvent) error {
+	port := viper.GetString("NOTIFY_SMTP_PORT")
+	if port == "" {
+		port = "25"
+	}
+	from := viper.GetString("NOTIFY_SMTP_FROM")
+	var to []string
+	for _, recipient := range strings.Split(viper.GetString("NOTIFY_SMTP_TO"), ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			to = append(to, recipient)
+		}
+	}
+	if from == "" || len(to) == 0 {
+		return fmt.Errorf("NOTIFY_SMTP_FROM and NOTIFY_SMTP_TO are required for email notifications")
+	}
+
+	var auth smtp.Auth
+	if user := viper.GetString("NOTIFY_SMTP_USER"); user != "" {
+		password, err := Secret("NOTIFY_SMTP_PASS")
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+
+	subject := fmt.Sprintf("[CSEFileManager] %s job %d %s on %s", event.JobType, event.JobId, event.Event, event.Host)
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		from, strings.Join(to, ", "), subject, strings.ReplaceAll(event.Message, "\n", "\r\n"))
+
+	if err := sendMail(net.JoinHostPort(host, port), host, auth, from, to, redactSecrets([]byte(message))); err != nil {
+		return err
+	}
+	log.Info().Msgf("sent %s email for %s job %d to %s", event.Event, event.JobType, event.JobId, strings.Join(to, ", "))
+	return nil
+}
+
+// sendMail is smtp.SendMail within notifyTimeout: the dial, the STARTTLS upgrade and the whole exchange share one deadline
+func sendMail(address, host string, auth smtp.Auth, from string, to []string, message []byte) error {
+	conn, err := net.DialTimeout("tcp", address, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(notifyTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
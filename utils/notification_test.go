@@ -0,0 +1,282 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// webhookRecorder is a webhook endpoint keeping the bodies it receives
+type webhookRecorder struct {
+	mu     sync.Mutex
+	status int
+	bodies [][]byte
+}
+
+func (w *webhookRecorder) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	body, _ := io.ReadAll(request.Body)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/json" {
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.bodies = append(w.bodies, body)
+	if w.status != 0 {
+		response.WriteHeader(w.status)
+	}
+}
+
+func withSettings(t *testing.T, settings map[string]any) {
+	t.Helper()
+	for key, value := range settings {
+		viper.Set(key, value)
+	}
+	t.Cleanup(func() {
+		for key := range settings {
+			viper.Set(key, nil)
+		}
+	})
+}
+
+func withNotifyTimeout(t *testing.T, timeout time.Duration) {
+	previous := notifyTimeout
+	notifyTimeout = timeout
+	t.Cleanup(func() { notifyTimeout = previous })
+}
+
+func failedRunReport() *models.RunReport {
+	report := models.NewRunReport("FUPM")
+	report.AddMatched(1, 2)
+	report.AddFile(1, "/in/a.csv", models.FileStatusTransferred, nil, 10, 10, time.Now())
+	report.AddFailure(1, "/in/b.csv", "transfer", io.ErrUnexpectedEOF, 10, 0, time.Now())
+	report.AddMatched(2, 0)
+	report.Finish()
+	return report
+}
+
+func TestSendWebhookFormats(t *testing.T) {
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	event := NotificationEvent{Event: EventFailure, JobType: "FUPM", JobId: 1, Failed: 1, Message: "line one\nline two"}
+
+	for _, format := range []string{"json", "slack", "teams"} {
+		if err := sendWebhook(server.URL, format, event); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+	}
+
+	var received NotificationEvent
+	if err := json.Unmarshal(recorder.bodies[0], &received); err != nil || received.Event != EventFailure || received.JobId != 1 || received.Failed != 1 {
+		t.Fatalf("json payload %s, %v", recorder.bodies[0], err)
+	}
+	var slack map[string]string
+	if err := json.Unmarshal(recorder.bodies[1], &slack); err != nil || slack["text"] != event.Message {
+		t.Fatalf("slack payload %s, %v", recorder.bodies[1], err)
+	}
+	var teams map[string]string
+	if err := json.Unmarshal(recorder.bodies[2], &teams); err != nil || teams["@type"] != "MessageCard" ||
+		teams["text"] != "line one<br>line two" || teams["summary"] != "FUPM job 1 failure" {
+		t.Fatalf("teams payload %s, %v", recorder.bodies[2], err)
+	}
+}
+
+func TestSendWebhookFailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(&webhookRecorder{status: http.StatusInternalServerError})
+	defer server.Close()
+
+	err := sendWebhook(server.URL, "json", NotificationEvent{Event: EventFailure})
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("got %v, want the 500 status", err)
+	}
+}
+
+func TestSendWebhookTimesOut(t *testing.T) {
+	withNotifyTimeout(t, 100*time.Millisecond)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-release }))
+	defer server.Close()
+	defer close(release)
+
+	start := time.Now()
+	if err := sendWebhook(server.URL, "json", NotificationEvent{Event: EventFailure}); err == nil {
+		t.Fatal("webhook hanging forever succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("webhook gave up after %s", elapsed)
+	}
+}
+
+func TestNotifyRunOutcomeSendsEnabledEvents(t *testing.T) {
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	withSettings(t, map[string]any{
+		"NOTIFY_WEBHOOK_URL":    server.URL,
+		"NOTIFY_WEBHOOK_FORMAT": "json",
+		"NOTIFY_ON":             EventFailure + "," + EventCompletion,
+	})
+
+	NotifyRunOutcome(failedRunReport(), map[int]string{1: "{{.JobType}} {{.JobId}}: {{.Failed}} failed"})
+
+	// job 2 matched nothing, missing_files is not enabled
+	if len(recorder.bodies) != 1 {
+		t.Fatalf("got %d webhooks, want 1", len(recorder.bodies))
+	}
+	var event NotificationEvent
+	if err := json.Unmarshal(recorder.bodies[0], &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Event != EventFailure || event.JobId != 1 || event.Succeeded != 1 || event.Failed != 1 || event.Message != "FUPM 1: 1 failed" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if len(event.Failures) != 1 || event.Failures[0].File != "/in/b.csv" {
+		t.Fatalf("unexpected failures %+v", event.Failures)
+	}
+}
+
+// startSmtpServer answers just enough SMTP to take one message, which it hands to the returned channel
+func startSmtpServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 localhost ESMTP")
+		var data strings.Builder
+		for inData := false; ; {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case inData && command == ".":
+				inData = false
+				messages <- data.String()
+				reply("250 queued")
+			case inData:
+				data.WriteString(line)
+			case strings.HasPrefix(command, "EHLO"):
+				reply("250 localhost")
+			case command == "DATA":
+				inData = true
+				reply("354 go ahead")
+			case command == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func TestSendMail(t *testing.T) {
+	address, messages := startSmtpServer(t)
+	host, port, _ := net.SplitHostPort(address)
+	withSettings(t, map[string]any{
+		"NOTIFY_SMTP_PORT": port,
+		"NOTIFY_SMTP_FROM": "cse@example.com",
+		"NOTIFY_SMTP_TO":   "ops@example.com, oncall@example.com",
+	})
+
+	event := NotificationEvent{Event: EventFailure, JobType: "ARCHIVE", JobId: 3, Host: "host1", Message: "1 failed"}
+	if err := sendEmail(host, event); err != nil {
+		t.Fatal(err)
+	}
+	message := <-messages
+	if !strings.Contains(message, "Subject: [CSEFileManager] ARCHIVE job 3 failure on host1") || !strings.Contains(message, "1 failed") {
+		t.Fatalf("unexpected message %q", message)
+	}
+}
+
+func TestSendMailTimesOut(t *testing.T) {
+	withNotifyTimeout(t, 100*time.Millisecond)
+	// accepts the connection but never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	start := time.Now()
+	if err := sendMail(listener.Addr().String(), "127.0.0.1", nil, "cse@example.com", []string{"ops@example.com"}, []byte("hi")); err == nil {
+		t.Fatal("mail to a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("mail gave up after %s", elapsed)
+	}
+}
+
+func TestNotificationsRedactSecrets(t *testing.T) {
+	const secret = "n0tify-s3cret"
+	RedactSecret(secret)
+	report := models.NewRunReport("FUPM")
+	report.AddMatched(1, 1)
+	report.AddFailure(1, "/in/a.csv", "db_insert", errors.New("ORA-01017: invalid password "+secret), 10, 10, time.Now())
+	report.JobFailed(1, errors.New(`dial oracle://user:`+secret+`@db:1521 failed, "`+secret+`"`))
+	report.Finish()
+
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	address, messages := startSmtpServer(t)
+	host, port, _ := net.SplitHostPort(address)
+	withSettings(t, map[string]any{
+		"NOTIFY_WEBHOOK_URL":    server.URL,
+		"NOTIFY_WEBHOOK_FORMAT": "json",
+		"NOTIFY_ON":             EventFailure,
+		"NOTIFY_SMTP_HOST":      host,
+		"NOTIFY_SMTP_PORT":      port,
+		"NOTIFY_SMTP_FROM":      "cse@example.com",
+		"NOTIFY_SMTP_TO":        "ops@example.com",
+	})
+
+	NotifyRunOutcome(report, nil)
+
+	if len(recorder.bodies) != 1 {
+		t.Fatalf("got %d webhooks, want 1", len(recorder.bodies))
+	}
+	for name, payload := range map[string]string{"webhook": string(recorder.bodies[0]), "email": <-messages} {
+		if strings.Contains(payload, secret) || !strings.Contains(payload, RedactedSecret) {
+			t.Errorf("%s payload not redacted: %s", name, payload)
+		}
+	}
+	var event NotificationEvent
+	if err := json.Unmarshal(recorder.bodies[0], &event); err != nil {
+		t.Fatalf("redacted payload is not json: %v", err)
+	}
+	if event.Failures[0].Error != "ORA-01017: invalid password "+RedactedSecret {
+		t.Fatalf("failure error %q", event.Failures[0].Error)
+	}
+}
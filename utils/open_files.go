@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// fileID identifies a file by device and inode, so renamed or symlinked paths still match
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// OpenFiles maps the files held open by other processes to one of their pids
+type OpenFiles map[fileID]int
+
+// OpenedBy returns the pid of a process holding the file open, 0 when none does
+func (o OpenFiles) OpenedBy(info os.FileInfo) int {
+	if o == nil {
+		return 0
+	}
+	id, ok := fileIdentity(info)
+	if !ok {
+		return 0
+	}
+	return o[id]
+}
+
+// canDetectOpenFiles is true for the local disk on platforms with a process table to scan
+func canDetectOpenFiles(fs afero.Fs) bool {
+	_, local := fs.(*afero.OsFs)
+	return local && openFilesSupported
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const openFilesSupported = true
+
+// ScanOpenFiles walks /proc/*/fd, processes we are not allowed to look into are left out
+func ScanOpenFiles() (OpenFiles, error) {
+	processes, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	open := make(OpenFiles)
+	for _, process := range processes {
+		pid, err := strconv.Atoi(process.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		fdDir := filepath.Join("/proc", process.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			// stat follows the fd link to the file itself
+			info, err := os.Stat(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if id, ok := fileIdentity(info); ok {
+				open[id] = pid
+			}
+		}
+	}
+	return open, nil
+}
+
+func fileIdentity(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: stat.Ino}, true
+}
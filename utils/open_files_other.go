@@ -0,0 +1,16 @@
+//go:build !linux
+
+package utils
+
+import "os"
+
+const openFilesSupported = false
+
+// ScanOpenFiles has no process table to read here, no file is reported open
+func ScanOpenFiles() (OpenFiles, error) {
+	return nil, nil
+}
+
+func fileIdentity(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"CSEFileManager/models"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// LogRunSummary prints the totals of the run and one line per job
+func LogRunSummary(report *models.RunReport) {
+	statuses := make([]string, 0, len(report.Counts))
+	for status := range report.Counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	// job_type is on every line already
+	summary := log.Info().Str("run_id", report.RunId).Dur("duration", report.Duration)
+	for _, status := range statuses {
+		summary = summary.Int(status, report.Counts[status])
+	}
+	summary.Msg("run summary")
+
+	for _, job := range report.Jobs {
+		var bytesIn, bytesOut int64
+		failed := 0
+		for _, file := range job.Files {
+			bytesIn += file.BytesIn
+			bytesOut += file.BytesOut
+			if file.Status == models.FileStatusFailed {
+				failed++
+			}
+		}
+		logger := JobLogger(report, job.JobId, "")
+		if job.LockedBy != "" {
+			logger.Warn().Msgf("job %d: skipped, %s", job.JobId, job.LockedBy)
+			continue
+		}
+		event := logger.Info()
+		if job.Error != "" || failed > 0 {
+			event = logger.Warn().Str("job_error", job.Error)
+		}
+		event.Msgf("job %d: %d files matched, %d handled, %d failed, %d bytes in, %d bytes out",
+			job.JobId, job.FilesMatched, len(job.Files), failed, bytesIn, bytesOut)
+	}
+}
+
+// WriteRunReport writes the report as JSON, through a temporary file so readers never see a partial report
+func WriteRunReport(report *models.RunReport, path string) error {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run report: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create report directory: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return fmt.Errorf("failed to write run report %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to move run report into place %s: %w", path, err)
+	}
+	return nil
+}
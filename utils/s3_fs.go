@@ -0,0 +1,328 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/spf13/afero"
+)
+
+var errS3Unsupported = errors.New("operation not supported by object storage")
+
+// S3Fs is an afero.Fs over one bucket. Keys are plain paths, directories only exist as key prefixes,
+// so Mkdir is a no-op and files can be written once from start to end (multipart) or read.
+type S3Fs struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3Fs(client *minio.Client, bucket string) afero.Fs {
+	return S3Fs{client: client, bucket: bucket}
+}
+
+func (fs S3Fs) Name() string { return "s3fs" }
+
+func (fs S3Fs) Bucket() string { return fs.bucket }
+
+// key turns a file path into an object key, the bucket root is the empty key
+func (fs S3Fs) key(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+func (fs S3Fs) Create(name string) (afero.File, error) {
+	pipeReader, pipeWriter := io.Pipe()
+	file := &s3File{fs: fs, name: name, writer: pipeWriter, done: make(chan error, 1)}
+	go func() {
+		_, err := fs.client.PutObject(context.Background(), fs.bucket, fs.key(name), pipeReader, -1, minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+			PartSize:    s3PartSize,
+		})
+		pipeReader.CloseWithError(err)
+		file.done <- err
+	}()
+	return file, nil
+}
+
+func (fs S3Fs) Mkdir(name string, perm os.FileMode) error { return nil }
+
+func (fs S3Fs) MkdirAll(path string, perm os.FileMode) error { return nil }
+
+func (fs S3Fs) Open(name string) (afero.File, error) {
+	info, err := fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &s3File{fs: fs, name: name, info: info}, nil
+	}
+	object, err := fs.client.GetObject(context.Background(), fs.bucket, fs.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &s3File{fs: fs, name: name, info: info, object: object}, nil
+}
+
+func (fs S3Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_RDWR|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errS3Unsupported}
+	}
+	if flag&(os.O_WRONLY|os.O_CREATE) != 0 {
+		return fs.Create(name)
+	}
+	return fs.Open(name)
+}
+
+func (fs S3Fs) Remove(name string) error {
+	if err := fs.client.RemoveObject(context.Background(), fs.bucket, fs.key(name), minio.RemoveObjectOptions{}); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (fs S3Fs) RemoveAll(path string) error {
+	prefix := fs.key(path)
+	if prefix != "" {
+		prefix += "/"
+	}
+	for object := range fs.client.ListObjects(context.Background(), fs.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return &os.PathError{Op: "removeall", Path: path, Err: object.Err}
+		}
+		if err := fs.client.RemoveObject(context.Background(), fs.bucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			return &os.PathError{Op: "removeall", Path: path, Err: err}
+		}
+	}
+	if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Rename is a server side copy followed by a delete
+func (fs S3Fs) Rename(oldname, newname string) error {
+	_, err := fs.client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: fs.bucket, Object: fs.key(newname)},
+		minio.CopySrcOptions{Bucket: fs.bucket, Object: fs.key(oldname)},
+	)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return fs.Remove(oldname)
+}
+
+func (fs S3Fs) Stat(name string) (os.FileInfo, error) {
+	key := fs.key(name)
+	if key == "" {
+		return &s3FileInfo{name: "/", dir: true}, nil
+	}
+
+	object, err := fs.client.StatObject(context.Background(), fs.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return &s3FileInfo{name: path.Base(key), size: object.Size, modTime: object.LastModified}, nil
+	}
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	// not an object, it is a directory when anything lives under it
+	for object := range fs.client.ListObjects(context.Background(), fs.bucket, minio.ListObjectsOptions{Prefix: key + "/", MaxKeys: 1}) {
+		if object.Err != nil {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: object.Err}
+		}
+		return &s3FileInfo{name: path.Base(key), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs S3Fs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: errS3Unsupported}
+}
+
+func (fs S3Fs) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: errS3Unsupported}
+}
+
+func (fs S3Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: errS3Unsupported}
+}
+
+// s3File is either a directory listing, an object being read or an upload being written
+type s3File struct {
+	fs   S3Fs
+	name string
+	info os.FileInfo
+
+	object *minio.Object
+
+	writer  *io.PipeWriter
+	written int64
+	done    chan error
+
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (f *s3File) Name() string { return f.name }
+
+func (f *s3File) Close() error {
+	switch {
+	case f.object != nil:
+		return f.object.Close()
+	case f.writer != nil:
+		// the upload only completes once the stream is closed
+		f.writer.Close()
+		err := <-f.done
+		f.writer = nil
+		if err != nil {
+			return &os.PathError{Op: "close", Path: f.name, Err: err}
+		}
+	}
+	return nil
+}
+
+// Abort ends an upload without storing the object, the upload fails with the cause instead of completing
+func (f *s3File) Abort(cause error) error {
+	if f.writer == nil {
+		return f.Close()
+	}
+	f.writer.CloseWithError(cause)
+	<-f.done
+	f.writer = nil
+	return nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.object == nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+	}
+	return f.object.Read(p)
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if f.object == nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+	}
+	return f.object.ReadAt(p, off)
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	if f.object == nil {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errS3Unsupported}
+	}
+	return f.object.Seek(offset, whence)
+}
+
+func (f *s3File) Write(p []byte) (int, error) {
+	if f.writer == nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	n, err := f.writer.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *s3File) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: errS3Unsupported}
+}
+
+func (f *s3File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *s3File) Readdir(count int) ([]os.FileInfo, error) {
+	if f.info == nil || !f.info.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if !f.listed {
+		if err := f.list(); err != nil {
+			return nil, err
+		}
+	}
+
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+func (f *s3File) list() error {
+	prefix := f.fs.key(f.name)
+	if prefix != "" {
+		prefix += "/"
+	}
+	for object := range f.fs.client.ListObjects(context.Background(), f.fs.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return &os.PathError{Op: "readdir", Path: f.name, Err: object.Err}
+		}
+		// common prefixes come back with a trailing slash
+		name := strings.TrimSuffix(strings.TrimPrefix(object.Key, prefix), "/")
+		f.entries = append(f.entries, &s3FileInfo{
+			name:    name,
+			size:    object.Size,
+			modTime: object.LastModified,
+			dir:     strings.HasSuffix(object.Key, "/"),
+		})
+	}
+	f.listed = true
+	return nil
+}
+
+func (f *s3File) Readdirnames(n int) ([]string, error) {
+	entries, err := f.Readdir(n)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, err
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	if f.writer != nil {
+		return &s3FileInfo{name: path.Base(f.fs.key(f.name)), size: f.written, modTime: time.Now()}, nil
+	}
+	return f.info, nil
+}
+
+func (f *s3File) Sync() error { return nil }
+
+func (f *s3File) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: errS3Unsupported}
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *s3FileInfo) Name() string       { return i.name }
+func (i *s3FileInfo) Size() int64        { return i.size }
+func (i *s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i *s3FileInfo) IsDir() bool        { return i.dir }
+func (i *s3FileInfo) Sys() any           { return nil }
+
+func (i *s3FileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	S3Scheme = "s3://"
+
+	// part size for multipart uploads of streams with unknown length
+	s3PartSize = 16 * 1024 * 1024
+)
+
+var (
+	s3ClientMu       sync.Mutex
+	s3Client         *minio.Client
+	s3ClientErr      error
+	s3ClientSettings string // the S3_* settings the client was built from
+)
+
+// S3Location is a bucket and key prefix parsed from an s3://bucket/prefix URI
+type S3Location struct {
+	Bucket string
+	Prefix string
+}
+
+func IsS3URI(uri string) bool {
+	return strings.HasPrefix(strings.ToLower(uri), S3Scheme)
+}
+
+func ParseS3URI(uri string) (S3Location, error) {
+	if !IsS3URI(uri) {
+		return S3Location{}, fmt.Errorf("%s is not an s3 uri", uri)
+	}
+	bucket, prefix, _ := strings.Cut(uri[len(S3Scheme):], "/")
+	if bucket == "" {
+		return S3Location{}, fmt.Errorf("s3 uri %s has no bucket", uri)
+	}
+	return S3Location{Bucket: bucket, Prefix: strings.Trim(prefix, "/")}, nil
+}
+
+// GetS3Client returns the shared client, built from the S3_* settings on first use
+// and built again when a config reload changed them
+func GetS3Client() (*minio.Client, error) {
+	s3ClientMu.Lock()
+	defer s3ClientMu.Unlock()
+	settings := fmt.Sprintf("%q %q %q %q %t", viper.GetString("S3_ENDPOINT"), viper.GetString("S3_REGION"),
+		viper.GetString("S3_ACCESS_KEY"), viper.GetString("S3_SECRET_KEY"), viper.GetBool("S3_USE_SSL"))
+	if s3Client != nil || s3ClientErr != nil {
+		if settings == s3ClientSettings {
+			return s3Client, s3ClientErr
+		}
+		log.Info().Msg("S3 settings changed, connecting with the new ones")
+	}
+	s3ClientSettings = settings
+	s3Client, s3ClientErr = newS3Client()
+	return s3Client, s3ClientErr
+}
+
+func newS3Client() (*minio.Client, error) {
+	endpoint := viper.GetString("S3_ENDPOINT")
+	if endpoint == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT is not configured")
+	}
+	secretKey, err := Secret("S3_SECRET_KEY")
+	if err != nil {
+		return nil, err
+	}
+	return minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(viper.GetString("S3_ACCESS_KEY"), secretKey, ""),
+		Secure: viper.GetBool("S3_USE_SSL"),
+		Region: viper.GetString("S3_REGION"),
+	})
+}
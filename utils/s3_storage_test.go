@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestGetS3ClientFollowsSettingsReload(t *testing.T) {
+	t.Cleanup(func() { s3Client, s3ClientErr, s3ClientSettings = nil, nil, "" })
+	withSettings(t, map[string]any{"S3_ENDPOINT": "", "S3_ACCESS_KEY": "key", "S3_SECRET_KEY": "secret"})
+	if _, err := GetS3Client(); err == nil {
+		t.Fatal("client built without an endpoint")
+	}
+
+	useEndpoint := func(endpoint string) *minio.Client {
+		t.Helper()
+		withSettings(t, map[string]any{"S3_ENDPOINT": endpoint})
+		client, err := GetS3Client()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.EndpointURL().Host != endpoint {
+			t.Fatalf("client for %s, want %s", client.EndpointURL().Host, endpoint)
+		}
+		return client
+	}
+	first := useEndpoint("minio-a:9000")
+	if useEndpoint("minio-a:9000") != first {
+		t.Fatal("client built again for unchanged settings")
+	}
+	if useEndpoint("minio-b:9000") == first {
+		t.Fatal("client kept after the endpoint changed")
+	}
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// A setting holding one of these prefixes is read from where it points to
+const (
+	secretEnvPrefix       = "env:"
+	secretFilePrefix      = "file:"
+	secretEncryptedPrefix = "enc:"
+)
+
+// RedactedSecret replaces secrets in the logs
+const RedactedSecret = "******"
+
+// secretSettingParts mark the settings holding secrets, by a part of their name
+var secretSettingParts = []string{"PASS", "SECRET", "TOKEN"}
+
+// redactedSecrets holds every form of the secrets read so far, longest first
+var redactedSecrets = struct {
+	sync.RWMutex
+	values [][]byte
+}{}
+
+// IsSecretSetting tells whether the setting holds a password or another secret
+func IsSecretSetting(key string) bool {
+	key = strings.ToUpper(key)
+	for _, part := range secretSettingParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveSetting reads a setting that may point elsewhere: env:NAME reads an environment variable, file:/path a file
+// (Docker and Kubernetes secrets) and enc:BASE64 an age encrypted value, decrypted with the identity file in
+// SETTINGS_IDENTITY_PATH. Other values are used as is, an unset setting falls back to the environment variable of its name.
+func ResolveSetting(key string) (string, error) {
+	value := viper.GetString(key)
+	if value == "" {
+		value = os.Getenv(key)
+	}
+	resolved, err := resolveSettingValue(value)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", key, err)
+	}
+	return resolved, nil
+}
+
+// Secret resolves a secret setting like ResolveSetting, its value is redacted from every log line from then on
+func Secret(key string) (string, error) {
+	value, err := ResolveSetting(key)
+	if err != nil {
+		return "", err
+	}
+	RedactSecret(value)
+	return value, nil
+}
+
+func resolveSettingValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		resolved, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return resolved, nil
+	case strings.HasPrefix(value, secretFilePrefix):
+		return readSecretFile(strings.TrimPrefix(value, secretFilePrefix))
+	case strings.HasPrefix(value, secretEncryptedPrefix):
+		return decryptSecret(strings.TrimPrefix(value, secretEncryptedPrefix))
+	}
+	return value, nil
+}
+
+// readSecretFile reads a secret from a file others cannot write, without its trailing line break
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return "", fmt.Errorf("secret file %s is writable by others (mode %s)", path, info.Mode().Perm())
+	}
+	if info.Mode().Perm()&0004 != 0 {
+		log.Warn().Msgf("secret file %s is readable by everyone (mode %s), restrict it to its owner", path, info.Mode().Perm())
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// decryptSecret decrypts a base64 encoded age value, as given by: echo -n secret | age -r <recipient> | base64 -w0
+func decryptSecret(encoded string) (string, error) {
+	identityPath := viper.GetString("SETTINGS_IDENTITY_PATH")
+	if identityPath == "" {
+		return "", fmt.Errorf("encrypted value needs SETTINGS_IDENTITY_PATH")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", fmt.Errorf("encrypted value is not base64: %w", err)
+	}
+	identities, err := LoadIdentities(identityPath)
+	if err != nil {
+		return "", err
+	}
+	decrypted, err := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %w", err)
+	}
+	plaintext, err := io.ReadAll(decrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// RedactSecret hides the value from the logs, as written and as escaped in JSON and URLs.
+// Values under 4 characters are left alone, redacting them would mangle every line they appear in.
+func RedactSecret(value string) {
+	if len(value) < 4 {
+		return
+	}
+	forms := []string{value, url.QueryEscape(value)}
+	if quoted, err := json.Marshal(value); err == nil {
+		forms = append(forms, string(quoted[1:len(quoted)-1]))
+	}
+	// connection urls escape it as user info, or as a path segment like go_ora does
+	forms = append(forms, strings.TrimPrefix(url.UserPassword("", value).String(), ":"), url.PathEscape(value))
+
+	redactedSecrets.Lock()
+	defer redactedSecrets.Unlock()
+	for _, form := range forms {
+		known := false
+		for _, existing := range redactedSecrets.values {
+			known = known || string(existing) == form
+		}
+		if !known {
+			redactedSecrets.values = append(redactedSecrets.values, []byte(form))
+		}
+	}
+	// a secret containing another one is replaced first
+	sort.Slice(redactedSecrets.values, func(i, j int) bool {
+		return len(redactedSecrets.values[i]) > len(redactedSecrets.values[j])
+	})
+}
+
+// RedactSecretSettings reads every secret setting of the config file so its value is redacted before anything logs it.
+// Settings that cannot be read are reported, and fail again where they are used.
+func RedactSecretSettings() {
+	for _, key := range viper.AllKeys() {
+		if !IsSecretSetting(key) {
+			continue
+		}
+		if _, err := Secret(strings.ToUpper(key)); err != nil {
+			log.Warn().Err(err).Msg("unable to read secret setting")
+		}
+	}
+}
+
+// redactSecrets replaces the known secrets in p, p is returned as is when it holds none
+func redactSecrets(p []byte) []byte {
+	redactedSecrets.RLock()
+	defer redactedSecrets.RUnlock()
+	for _, secret := range redactedSecrets.values {
+		if bytes.Contains(p, secret) {
+			p = bytes.ReplaceAll(p, secret, []byte(RedactedSecret))
+		}
+	}
+	return p
+}
+
+// RedactingWriter hides the known secrets from the log lines written through it
+type RedactingWriter struct {
+	w zerolog.LevelWriter
+}
+
+func NewRedactingWriter(w zerolog.LevelWriter) *RedactingWriter {
+	return &RedactingWriter{w: w}
+}
+
+func (r *RedactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write(redactSecrets(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (r *RedactingWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if _, err := r.w.WriteLevel(level, redactSecrets(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
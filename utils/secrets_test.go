@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/rs/zerolog"
+)
+
+// secretFile writes the secret followed by a line break, with the given permissions
+func secretFile(t *testing.T, content string, perm os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(content+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// settingsIdentity makes a new identity and sets its file as SETTINGS_IDENTITY_PATH
+func settingsIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityPath := filepath.Join(t.TempDir(), "identity.txt")
+	if err := os.WriteFile(identityPath, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withSettings(t, map[string]any{"SETTINGS_IDENTITY_PATH": identityPath})
+	return identity
+}
+
+// encryptedSetting is the enc: form of the value, encrypted to the recipient
+func encryptedSetting(t *testing.T, recipient age.Recipient, value string) string {
+	t.Helper()
+	var ciphertext bytes.Buffer
+	encrypted, err := age.Encrypt(&ciphertext, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted.Write([]byte(value))
+	if err := encrypted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return secretEncryptedPrefix + base64.StdEncoding.EncodeToString(ciphertext.Bytes())
+}
+
+func TestResolveSetting(t *testing.T) {
+	t.Setenv("CSE_TEST_PASS", "from-env")
+	t.Setenv("CSE_TEST_FALLBACK_PASS", "fallback")
+	encrypted := encryptedSetting(t, settingsIdentity(t).Recipient(), "from-age")
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name, value, want string
+		fails             bool
+	}{
+		{"plain", "as-is", "as-is", false},
+		{"env", "env:CSE_TEST_PASS", "from-env", false},
+		{"env unset", "env:CSE_TEST_UNSET", "", true},
+		{"file", "file:" + secretFile(t, "from-file", 0600), "from-file", false},
+		{"file readable by everyone", "file:" + secretFile(t, "from-file", 0644), "from-file", false},
+		{"file writable by the group", "file:" + secretFile(t, "from-file", 0620), "", true},
+		{"file writable by others", "file:" + secretFile(t, "from-file", 0602), "", true},
+		{"file missing", "file:" + filepath.Join(t.TempDir(), "missing"), "", true},
+		{"enc", encrypted, "from-age", false},
+		{"enc not base64", "enc:not base64!", "", true},
+		{"enc for another identity", encryptedSetting(t, other.Recipient(), "other"), "", true},
+	} {
+		withSettings(t, map[string]any{"CSE_TEST_SETTING": test.value})
+		got, err := ResolveSetting("CSE_TEST_SETTING")
+		if (err != nil) != test.fails || got != test.want {
+			t.Errorf("%s: got %q, %v", test.name, got, err)
+		}
+	}
+
+	withSettings(t, map[string]any{"SETTINGS_IDENTITY_PATH": "", "CSE_TEST_SETTING": encrypted})
+	if _, err := ResolveSetting("CSE_TEST_SETTING"); err == nil || !strings.Contains(err.Error(), "SETTINGS_IDENTITY_PATH") {
+		t.Errorf("enc without identity: got %v", err)
+	}
+	withSettings(t, map[string]any{"CSE_TEST_FALLBACK_PASS": ""})
+	if got, err := ResolveSetting("CSE_TEST_FALLBACK_PASS"); err != nil || got != "fallback" {
+		t.Errorf("unset setting: got %q, %v, want its environment variable", got, err)
+	}
+}
+
+func TestRedactSecretForms(t *testing.T) {
+	const secret = `p@ss w/"rd&é`
+	RedactSecret(secret)
+	quoted, _ := json.Marshal(secret)
+	userinfo := strings.TrimPrefix(url.UserPassword("", secret).String(), ":")
+
+	for name, line := range map[string]string{
+		"raw":      "password is " + secret + "!",
+		"query":    "https://host/?token=" + url.QueryEscape(secret) + "&x=1",
+		"json":     `{"message":` + string(quoted) + `}`,
+		"userinfo": "oracle://user:" + userinfo + "@db:1521/svc",
+		"path":     "oracle://db/" + url.PathEscape(secret),
+	} {
+		redacted := string(redactSecrets([]byte(line)))
+		if !strings.Contains(redacted, RedactedSecret) {
+			t.Errorf("%s form not redacted: %s", name, redacted)
+		}
+		for _, part := range []string{"p@ss", "ss w", "rd&"} {
+			if strings.Contains(redacted, part) {
+				t.Errorf("%s form left %q behind: %s", name, part, redacted)
+			}
+		}
+	}
+
+	RedactSecret("abc")
+	if got := string(redactSecrets([]byte("abcdef"))); got != "abcdef" {
+		t.Errorf("short value redacted: %s", got)
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	RedactSecret("writer-s3cret")
+	var out bytes.Buffer
+	writer := NewRedactingWriter(zerolog.LevelWriterAdapter{Writer: &out})
+	line := `{"message":"connect with writer-s3cret"}` + "\n"
+	if n, err := writer.Write([]byte(line)); err != nil || n != len(line) {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	if got := out.String(); got != `{"message":"connect with `+RedactedSecret+`"}`+"\n" {
+		t.Fatalf("got %s", got)
+	}
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// LocalFs is the local disk. It is shared so that same-filesystem moves can be detected,
+// and can be swapped for afero.NewMemMapFs() to run jobs in memory.
+var LocalFs afero.Fs = afero.NewOsFs()
+
+// ResolveStorage maps a configured path to the filesystem serving it and the path inside that filesystem.
+// s3://bucket/prefix resolves to the bucket, anything else to local disk.
+func ResolveStorage(location string) (afero.Fs, string, error) {
+	if !IsS3URI(location) {
+		return LocalFs, location, nil
+	}
+	loc, err := ParseS3URI(location)
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := GetS3Client()
+	if err != nil {
+		return nil, "", err
+	}
+	return NewS3Fs(client, loc.Bucket), loc.Prefix, nil
+}
+
+// DescribeLocation renders a path inside a filesystem the way it is written in the config, for logs and the registry
+func DescribeLocation(fs afero.Fs, name string) string {
+	if s3fs, ok := fs.(S3Fs); ok {
+		return S3Scheme + s3fs.Bucket() + "/" + s3fs.key(name)
+	}
+	return filepath.Clean(name)
+}
+
+// AbortFile closes a file whose writes failed. An upload to object storage is cancelled so no truncated object is
+// stored, other files are closed as they are and left for the caller to remove.
+func AbortFile(file afero.File, cause error) {
+	if aborter, ok := file.(interface{ Abort(error) error }); ok {
+		aborter.Abort(cause)
+		return
+	}
+	file.Close()
+}
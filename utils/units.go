@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	dayUnitPattern = regexp.MustCompile(`(\d+(?:\.\d+)?)([dw])`)
+	sizePattern    = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(?:([KMGT])I?)?B?$`)
+)
+
+// ParseDuration is time.ParseDuration with d (24h) and w (7d) units, e.g. 7d, 1d12h, 30m
+func ParseDuration(value string) (time.Duration, error) {
+	expanded := dayUnitPattern.ReplaceAllStringFunc(strings.TrimSpace(value), func(part string) string {
+		match := dayUnitPattern.FindStringSubmatch(part)
+		number, _ := strconv.ParseFloat(match[1], 64)
+		hours := number * 24
+		if match[2] == "w" {
+			hours *= 7
+		}
+		return strconv.FormatFloat(hours, 'f', -1, 64) + "h"
+	})
+	duration, err := time.ParseDuration(expanded)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, expected values like 30m, 12h or 7d", value)
+	}
+	return duration, nil
+}
+
+// ParseSize reads sizes like 500MB, 1.5GB or 1024, units are powers of 1024 and a bare number is in bytes
+func ParseSize(value string) (int64, error) {
+	match := sizePattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q, expected values like 500MB or 2GB", value)
+	}
+	number, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", value, err)
+	}
+	multiplier := float64(1)
+	if match[2] != "" {
+		multiplier = float64(int64(1) << (10 * (strings.Index("KMGT", match[2]) + 1)))
+	}
+	return int64(number * multiplier), nil
+}
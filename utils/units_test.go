@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  int64
+	}{
+		{"1024", 1024},
+		{"500B", 500},
+		{"500MB", 500 << 20},
+		{"500mb", 500 << 20},
+		{"500 MB", 500 << 20},
+		{"500M", 500 << 20},
+		{"500MiB", 500 << 20},
+		{"1.5GB", 3 << 29},
+		{"2K", 2048},
+		{"1TB", 1 << 40},
+		{" 10KB ", 10240},
+	} {
+		if got, err := ParseSize(test.value); err != nil || got != test.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", test.value, got, err, test.want)
+		}
+	}
+	for _, value := range []string{"", "MB", "-5MB", "5PB", "5 megabytes", "1,5GB"} {
+		if got, err := ParseSize(value); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want an error", value, got)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"30m", 30 * time.Minute},
+		{"12h", 12 * time.Hour},
+		{"7d", 7 * 24 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"1d12h", 36 * time.Hour},
+		{"1.5d", 36 * time.Hour},
+		{" 90s ", 90 * time.Second},
+	} {
+		if got, err := ParseDuration(test.value); err != nil || got != test.want {
+			t.Errorf("ParseDuration(%q) = %s, %v, want %s", test.value, got, err, test.want)
+		}
+	}
+	for _, value := range []string{"", "7", "7 days", "d", "1y"} {
+		if got, err := ParseDuration(value); err == nil {
+			t.Errorf("ParseDuration(%q) = %s, want an error", value, got)
+		}
+	}
+}